@@ -80,7 +80,9 @@ func getProfileKeys(profileName string) (profiles []string) {
 	return
 }
 
-func getAWSConf(projectName string) (sess *session.Session, err error) {
+// getAWSConf makes a session using the credentials for projectName. If region
+// is given, it overrides the profile's region.
+func getAWSConf(projectName string, region string) (sess *session.Session, err error) {
 	var creds *credentials.Credentials
 	hasPrefix := false
 	confFn := os.Getenv("AWS_CONFIG_FILE")
@@ -91,9 +93,11 @@ func getAWSConf(projectName string) (sess *session.Session, err error) {
 			hasPrefix = true
 		}
 	}
-	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" && (os.Getenv("AWS_DEFAULT_REGION") != "" || os.Getenv("AWS_REGION") != "") {
+	if usesEnvCredentials() {
 		creds = credentials.NewEnvCredentials()
-		region := os.Getenv("AWS_DEFAULT_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
 		sess = session.New(&aws.Config{Credentials: creds, Region: &region})
 	} else {
 		var iniFile *ini.File
@@ -115,6 +119,9 @@ func getAWSConf(projectName string) (sess *session.Session, err error) {
 				log.Fatal(err)
 			}
 		}
+		if region != "" {
+			profile.Region = region
+		}
 		setProfileDefaults(&profile)
 		creds = loadCachedCreds(profile)
 		if creds == nil {
@@ -134,6 +141,13 @@ func getAWSConf(projectName string) (sess *session.Session, err error) {
 	return
 }
 
+// usesEnvCredentials is whether credentials are taken from the environment,
+// rather than the profile asked for.
+func usesEnvCredentials() bool {
+	return os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" &&
+		(os.Getenv("AWS_DEFAULT_REGION") != "" || os.Getenv("AWS_REGION") != "")
+}
+
 func setProfileDefaults(profile *Profile) {
 	if profile.Region == "" {
 		profile.Region = DefaultRegion
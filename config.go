@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// ConfigFile is the per-project configuration, found the same way as the
+// project name file: in the current directory or one of its parents. It's an
+// ini file; see the usage for the sections it may contain.
+const ConfigFile = ".moltar-config"
+
+const (
+	PackagesFormatPipe  = "pipe"
+	PackagesFormatComma = "comma"
+)
+
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultConnectRetries = 2
+)
+
+const (
+	AddressPublicDns  = "public-dns"
+	AddressPublicIp   = "public-ip"
+	AddressPrivateDns = "private-dns"
+	AddressPrivateIp  = "private-ip"
+)
+
+// TagSchema maps moltar's concepts to the tag keys used on instances.
+type TagSchema struct {
+	Project        string
+	Environment    string
+	Cluster        string
+	Packages       string
+	Name           string
+	SshUser        string
+	PackagesFormat string
+}
+
+var DefaultTagSchema = TagSchema{
+	Project:        "Project",
+	Environment:    "Environment",
+	Cluster:        "Cluster",
+	Packages:       "Packages",
+	Name:           "Name",
+	SshUser:        "SshUser",
+	PackagesFormat: PackagesFormatPipe,
+}
+
+// Target is an AWS region and credentials profile to look for instances in.
+type Target struct {
+	Name    string
+	Region  string
+	Profile string
+}
+
+type SshConfig struct {
+	// Address is which of an instance's addresses to connect to.
+	Address string
+	// Bastion is either [USER@]HOST[:PORT], or criteria as given to the ssh
+	// command, such as cluster=bastion, to find the bastion in the inventory.
+	Bastion string
+	// HostKeys is the host key policy, one of the HostKeys* constants.
+	HostKeys string
+	// KnownHostsFile is where moltar records host keys it has verified.
+	KnownHostsFile string
+	// IdentityFile is a private key to try before any others.
+	IdentityFile string
+	// User is the SSH user for instances not otherwise configured.
+	User string
+	// ConnectTimeout limits connecting and authenticating to each instance.
+	ConnectTimeout time.Duration
+	// ConnectRetries is how many more times to try connecting to an instance
+	// after a network error.
+	ConnectRetries int
+}
+
+// UserRule gives the SSH user for instances launched from an AMI, given by
+// its ID or a pattern matching its name.
+type UserRule struct {
+	Image string
+	User  string
+}
+
+type Config struct {
+	// Dir is the directory the config file was found in, or empty if there
+	// isn't one.
+	Dir     string
+	Tags    TagSchema
+	Targets []Target
+	Ssh     SshConfig
+	// Keys maps EC2 key pair names to private key files.
+	Keys map[string]string
+	// Users are checked in order for an instance's SSH user.
+	Users []UserRule
+}
+
+func loadConfig() (config *Config, err error) {
+	config = &Config{Tags: DefaultTagSchema, Keys: map[string]string{},
+		Ssh: SshConfig{HostKeys: HostKeysTofu,
+			KnownHostsFile: defaultMoltarKnownHostsFile(),
+			ConnectTimeout: DefaultConnectTimeout, ConnectRetries: DefaultConnectRetries}}
+
+	fn, err := findDotfile(ConfigFile)
+	if _, ok := err.(dotfileNotFoundError); ok {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	config.Dir = filepath.Dir(fn)
+
+	iniFile, err := ini.Load(fn)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load %s: %s", fn, err)
+	}
+
+	if section, err := iniFile.GetSection("tags"); err == nil {
+		readConfigString(section, "project", &config.Tags.Project)
+		readConfigString(section, "environment", &config.Tags.Environment)
+		readConfigString(section, "cluster", &config.Tags.Cluster)
+		readConfigString(section, "packages", &config.Tags.Packages)
+		readConfigString(section, "name", &config.Tags.Name)
+		readConfigString(section, "ssh_user", &config.Tags.SshUser)
+		readConfigString(section, "packages_format", &config.Tags.PackagesFormat)
+	}
+
+	if section, err := iniFile.GetSection("ssh"); err == nil {
+		readConfigString(section, "address", &config.Ssh.Address)
+		readConfigString(section, "bastion", &config.Ssh.Bastion)
+		readConfigString(section, "host_keys", &config.Ssh.HostKeys)
+		readConfigString(section, "known_hosts", &config.Ssh.KnownHostsFile)
+		config.Ssh.KnownHostsFile = expandHome(config.Ssh.KnownHostsFile)
+		readConfigString(section, "identity_file", &config.Ssh.IdentityFile)
+		readConfigString(section, "user", &config.Ssh.User)
+		if section.HasKey("connect_timeout") {
+			config.Ssh.ConnectTimeout, err = section.Key("connect_timeout").Duration()
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad ssh connect_timeout: %s", fn, err)
+			}
+		}
+		if section.HasKey("connect_retries") {
+			config.Ssh.ConnectRetries, err = section.Key("connect_retries").Int()
+			if err != nil || config.Ssh.ConnectRetries < 0 {
+				return nil, fmt.Errorf("%s: bad ssh connect_retries: %s", fn,
+					section.Key("connect_retries").String())
+			}
+		}
+	}
+
+	if section, err := iniFile.GetSection("users"); err == nil {
+		for _, key := range section.Keys() {
+			config.Users = append(config.Users, UserRule{Image: key.Name(), User: key.String()})
+		}
+	}
+
+	if section, err := iniFile.GetSection("keys"); err == nil {
+		for _, key := range section.Keys() {
+			config.Keys[key.Name()] = key.String()
+		}
+	}
+
+	for _, section := range iniFile.Sections() {
+		if !strings.HasPrefix(section.Name(), "target ") {
+			continue
+		}
+		target := Target{Name: strings.TrimSpace(strings.TrimPrefix(section.Name(), "target "))}
+		readConfigString(section, "region", &target.Region)
+		readConfigString(section, "profile", &target.Profile)
+		config.Targets = append(config.Targets, target)
+	}
+
+	switch config.Tags.PackagesFormat {
+	case PackagesFormatPipe, PackagesFormatComma:
+	default:
+		return nil, fmt.Errorf("%s: unknown packages_format %q; use %s or %s",
+			fn, config.Tags.PackagesFormat, PackagesFormatPipe, PackagesFormatComma)
+	}
+
+	if !isAddressMode(config.Ssh.Address) {
+		return nil, fmt.Errorf("%s: unknown ssh address %q", fn, config.Ssh.Address)
+	}
+	if !isHostKeysMode(config.Ssh.HostKeys) {
+		return nil, fmt.Errorf("%s: unknown ssh host_keys %q", fn, config.Ssh.HostKeys)
+	}
+
+	return config, nil
+}
+
+func isAddressMode(mode string) bool {
+	switch mode {
+	case "", AddressPublicDns, AddressPublicIp, AddressPrivateDns, AddressPrivateIp:
+		return true
+	}
+	return false
+}
+
+// expandHome expands a leading ~/ in a path to the user's home directory.
+func expandHome(fn string) string {
+	if strings.HasPrefix(fn, "~/") {
+		return filepath.Join(os.Getenv("HOME"), fn[2:])
+	}
+	return fn
+}
+
+func readConfigString(section *ini.Section, key string, value *string) {
+	if section.HasKey(key) {
+		*value = section.Key(key).String()
+	}
+}
+
+// PackageFilterValues gives the EC2 tag filter patterns that match a
+// packages tag containing packageName. They also match tags where it's only
+// part of a package's name, so hosts found with them must be checked with
+// HasPackage, which allows for spaces around the names as well.
+func (self TagSchema) PackageFilterValues(packageName string) []string {
+	return []string{"*" + packageName + "*"}
+}
+
+func (self TagSchema) PackageList(value string) (packages []string) {
+	sep := "|"
+	if self.PackagesFormat == PackagesFormatComma {
+		sep = ","
+	}
+	for _, p := range strings.Split(value, sep) {
+		if p = strings.TrimSpace(p); p != "" {
+			packages = append(packages, p)
+		}
+	}
+	return
+}
+
+func (self TagSchema) HasPackage(value string, packageName string) bool {
+	for _, p := range self.PackageList(value) {
+		if p == packageName {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether an instance launched from the given AMI matches.
+func (self UserRule) Matches(imageId string, imageName string) bool {
+	if self.Image == imageId {
+		return true
+	}
+	if imageName == "" {
+		return false
+	}
+	ok, _ := path.Match(self.Image, imageName)
+	return ok
+}
+
+// TagKey resolves a concept name such as "env" or "cluster" to the tag key
+// configured for it. Anything else is assumed to be a tag key already.
+func (self TagSchema) TagKey(name string) string {
+	switch strings.ToLower(name) {
+	case "project":
+		return self.Project
+	case "env", "environment":
+		return self.Environment
+	case "cluster":
+		return self.Cluster
+	case "packages", "package":
+		return self.Packages
+	case "name":
+		return self.Name
+	}
+	return name
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// HostKeysStrict only accepts hosts already in a known_hosts file.
+	HostKeysStrict = "strict"
+	// HostKeysTofu trusts and records the key of a host seen for the first
+	// time.
+	HostKeysTofu = "tofu"
+	// HostKeysConsole checks the key of a host seen for the first time
+	// against the keys printed in its EC2 console output before recording
+	// it.
+	HostKeysConsole = "console"
+)
+
+var ErrHostKeyNotInConsole = errors.New("host key isn't in the EC2 console output; it may not be available yet")
+
+// HostKeySource is implemented by inventories that can give a host's SSH host
+// keys out of band.
+type HostKeySource interface {
+	HostKeys(host *Host) ([]ssh.PublicKey, error)
+}
+
+func defaultMoltarKnownHostsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".moltar", "known_hosts")
+}
+
+func defaultUserKnownHostsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+func isHostKeysMode(mode string) bool {
+	switch mode {
+	case HostKeysStrict, HostKeysTofu, HostKeysConsole:
+		return true
+	}
+	return false
+}
+
+// hostKeyChecker verifies host keys against the user's known_hosts and
+// moltar's own, adding new keys to moltar's as the mode allows.
+type hostKeyChecker struct {
+	mode           string
+	userFile       string
+	moltarFile     string
+	moltarFileLock sync.Mutex
+	// sourceKeys are the keys fetched from the inventory by Prepare.
+	sourceKeys     map[*Host][]ssh.PublicKey
+	sourceKeysLock sync.Mutex
+}
+
+func newHostKeyChecker(config SshConfig) *hostKeyChecker {
+	return &hostKeyChecker{
+		mode:       config.HostKeys,
+		userFile:   defaultUserKnownHostsFile(),
+		moltarFile: config.KnownHostsFile,
+		sourceKeys: map[*Host][]ssh.PublicKey{},
+	}
+}
+
+func (self *hostKeyChecker) files() (files []string) {
+	for _, fn := range []string{self.userFile, self.moltarFile} {
+		if _, err := os.Stat(fn); err == nil {
+			files = append(files, fn)
+		}
+	}
+	return
+}
+
+// modeFor gives the mode for host. In console mode, a host whose inventory
+// can't give its keys, such as a bastion given by its address, is trusted on
+// first use.
+func (self *hostKeyChecker) modeFor(host *Host) string {
+	if self.mode == HostKeysConsole {
+		if _, ok := host.inventory.(HostKeySource); !ok {
+			return HostKeysTofu
+		}
+	}
+	return self.mode
+}
+
+// Callback gives the ssh.HostKeyCallback to connect to host with.
+func (self *hostKeyChecker) Callback(host *Host) ssh.HostKeyCallback {
+	mode := self.modeFor(host)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		self.moltarFileLock.Lock()
+		defer self.moltarFileLock.Unlock()
+
+		if files := self.files(); len(files) > 0 {
+			check, err := knownhosts.New(files...)
+			if err != nil {
+				return err
+			}
+			err = check(hostname, remote, key)
+			if keyErr, ok := err.(*knownhosts.KeyError); !ok || len(keyErr.Want) > 0 {
+				// Either known, or known with a different key.
+				return err
+			}
+		}
+
+		switch mode {
+		case HostKeysTofu:
+		case HostKeysConsole:
+			if err := self.verifyFromSource(host, key); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s isn't in %s", hostname, strings.Join(self.files(), " or "))
+		}
+
+		return self.addKnownHost(hostname, key)
+	}
+}
+
+// Prepare fetches host's keys from its inventory in console mode, if it isn't
+// already known, so that's done before connecting rather than during the
+// handshake.
+func (self *hostKeyChecker) Prepare(host *Host, hostname string) error {
+	if self.modeFor(host) != HostKeysConsole {
+		return nil
+	}
+	known, err := self.knownKeys(hostname)
+	if err != nil || len(known) > 0 {
+		return err
+	}
+
+	keys, err := sourceHostKeys(host)
+	if err != nil {
+		return err
+	}
+	self.sourceKeysLock.Lock()
+	defer self.sourceKeysLock.Unlock()
+	self.sourceKeys[host] = keys
+	return nil
+}
+
+// knownKeys gives the keys in the known_hosts files for hostname.
+func (self *hostKeyChecker) knownKeys(hostname string) ([]knownhosts.KnownKey, error) {
+	self.moltarFileLock.Lock()
+	defer self.moltarFileLock.Unlock()
+
+	files := self.files()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	// No key matches the placeholder, so every known one is given in the
+	// error.
+	err = check(hostname, &net.TCPAddr{IP: net.IPv4zero}, placeholderKey{})
+	if keyErr, ok := err.(*knownhosts.KeyError); ok {
+		return keyErr.Want, nil
+	}
+	return nil, err
+}
+
+// Algorithms gives the host key algorithms to accept from hostname: those of
+// its keys in the known_hosts files, so that the key that's known is the one
+// negotiated. It's nil if the host isn't known, to accept any.
+func (self *hostKeyChecker) Algorithms(hostname string) (algorithms []string, err error) {
+	known, err := self.knownKeys(hostname)
+	if err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, k := range known {
+		for _, algorithm := range hostKeyAlgorithms(k.Key.Type()) {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return
+}
+
+// hostKeyAlgorithms gives the algorithms that can be negotiated for a key
+// type. RSA keys can be used with SHA-2 signatures as well as the original.
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// placeholderKey is a public key that matches no other.
+type placeholderKey struct{}
+
+func (placeholderKey) Type() string                                 { return "" }
+func (placeholderKey) Marshal() []byte                              { return nil }
+func (placeholderKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("no key") }
+
+// LearnFromSource records the host keys the inventory gives for host, if it
+// isn't already known, so external ssh commands can verify it. It's only
+// needed in console mode, as those can trust on first use themselves.
+func (self *hostKeyChecker) LearnFromSource(host *Host, hostname string) error {
+	if self.modeFor(host) != HostKeysConsole {
+		return nil
+	}
+
+	self.moltarFileLock.Lock()
+	defer self.moltarFileLock.Unlock()
+
+	keys, err := sourceHostKeys(host)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	if files := self.files(); len(files) > 0 {
+		check, err := knownhosts.New(files...)
+		if err != nil {
+			return err
+		}
+		// The remote address is only used if the hostname is empty. If the
+		// host is already known, ssh can check its key itself.
+		err = check(hostname, &net.TCPAddr{IP: net.IPv4zero}, keys[0])
+		if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) > 0 {
+			return nil
+		} else if !ok {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		if err = self.addKnownHost(hostname, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *hostKeyChecker) addKnownHost(hostname string, key ssh.PublicKey) (err error) {
+	if err = os.MkdirAll(filepath.Dir(self.moltarFile), 0700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(self.moltarFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return
+}
+
+// SshOptions gives the options for external ssh commands to host that make
+// them use the same known_hosts files and policy.
+func (self *hostKeyChecker) SshOptions(host *Host) []string {
+	strict := "yes"
+	if self.modeFor(host) == HostKeysTofu {
+		strict = "accept-new"
+	}
+	return []string{
+		"-o", "UserKnownHostsFile=" + self.userFile + " " + self.moltarFile,
+		"-o", "StrictHostKeyChecking=" + strict,
+	}
+}
+
+func sourceHostKeys(host *Host) ([]ssh.PublicKey, error) {
+	source, ok := host.inventory.(HostKeySource)
+	if !ok {
+		return nil, fmt.Errorf("can't get host keys for %s from its inventory", host.Name)
+	}
+	return source.HostKeys(host)
+}
+
+// verifyFromSource checks key against those Prepare fetched for host, or
+// those its inventory gives if it wasn't called.
+func (self *hostKeyChecker) verifyFromSource(host *Host, key ssh.PublicKey) error {
+	self.sourceKeysLock.Lock()
+	keys, ok := self.sourceKeys[host]
+	self.sourceKeysLock.Unlock()
+	if !ok {
+		var err error
+		if keys, err = sourceHostKeys(host); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	return ErrHostKeyNotInConsole
+}
+
+// parseConsoleHostKeys finds the host keys that cloud-init prints to the
+// console on boot.
+func parseConsoleHostKeys(output []byte) (keys []ssh.PublicKey) {
+	inKeys := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.Contains(line, "-----BEGIN SSH HOST KEY KEYS-----"):
+			inKeys = true
+		case strings.Contains(line, "-----END SSH HOST KEY KEYS-----"):
+			inKeys = false
+		case inKeys:
+			if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// LargeResultSetWarning is the number of instances above which a query is
+// assumed to be broader than intended, and a warning is printed.
+var LargeResultSetWarning = 100
+
+var DescribeInstancesMaxRetries = 5
+var DescribeInstancesRetryDelay = 500 * time.Millisecond
+
+// Host is a machine moltar can connect to, as returned by an Inventory.
+type Host struct {
+	Id         string            `json:"id" yaml:"id"`
+	Name       string            `json:"name" yaml:"name"`
+	PublicDns  string            `json:"public_dns,omitempty" yaml:"public_dns"`
+	PublicIp   string            `json:"public_ip,omitempty" yaml:"public_ip"`
+	PrivateDns string            `json:"private_dns,omitempty" yaml:"private_dns"`
+	PrivateIp  string            `json:"private_ip,omitempty" yaml:"private_ip"`
+	Port       int               `json:"port,omitempty" yaml:"port"`
+	Tags       map[string]string `json:"tags,omitempty" yaml:"tags"`
+	SshUser    string            `json:"ssh_user,omitempty" yaml:"ssh_user"`
+	KeyName    string            `json:"key_name,omitempty" yaml:"key_name"`
+	ImageId    string            `json:"image_id,omitempty" yaml:"image_id"`
+	ImageName  string            `json:"image_name,omitempty" yaml:"image_name"`
+	Region     string            `json:"region,omitempty" yaml:"region"`
+	// AvailabilityZone is only set for hosts found in EC2.
+	AvailabilityZone string `json:"availability_zone,omitempty" yaml:"availability_zone"`
+	Account          string `json:"account,omitempty" yaml:"account"`
+
+	// Instance is only set for hosts found in EC2.
+	Instance *ec2.Instance `json:"-" yaml:"-"`
+
+	inventory Inventory
+}
+
+type InventoryQuery struct {
+	Project     string
+	Env         string
+	Cluster     string
+	PackageName string
+}
+
+// An Inventory finds the hosts matching a query. Empty query fields match
+// everything.
+type Inventory interface {
+	Hosts(query InventoryQuery) ([]*Host, error)
+}
+
+// Address gives the host's address of the kind given by mode, one of the
+// Address* constants. If the host doesn't have that kind of address, or mode
+// is empty, the first it does have is used, public before private.
+func (self *Host) Address(mode string) string {
+	var addr string
+	switch mode {
+	case AddressPublicDns:
+		addr = self.PublicDns
+	case AddressPublicIp:
+		addr = self.PublicIp
+	case AddressPrivateDns:
+		addr = self.PrivateDns
+	case AddressPrivateIp:
+		addr = self.PrivateIp
+	}
+	if addr != "" {
+		return addr
+	}
+
+	for _, addr := range []string{self.PublicDns, self.PublicIp, self.PrivateDns, self.PrivateIp} {
+		if addr != "" {
+			return addr
+		}
+	}
+	return ""
+}
+
+/// EC2
+
+type EC2Inventory struct {
+	svc    *ec2.EC2
+	tags   TagSchema
+	region string
+}
+
+func NewEC2Inventory(session *session.Session, tags TagSchema) *EC2Inventory {
+	return &EC2Inventory{svc: ec2.New(session), tags: tags,
+		region: aws.StringValue(session.Config.Region)}
+}
+
+func (self *EC2Inventory) Hosts(query InventoryQuery) (hosts []*Host, err error) {
+	params := &ec2.DescribeInstancesInput{
+		Filters: instanceFilters(self.tags, query.Project, query.Env,
+			query.Cluster, query.PackageName),
+	}
+
+	hosts = make([]*Host, 0, 20)
+	err = describeInstances(self.svc, params, func(res *ec2.Reservation) {
+		for _, instance := range res.Instances {
+			host := hostFromInstance(instance, self.tags)
+			if query.PackageName != "" &&
+				!self.tags.HasPackage(host.Tags[self.tags.Packages], query.PackageName) {
+				continue
+			}
+			host.Region = self.region
+			host.Account = aws.StringValue(res.OwnerId)
+			host.inventory = self
+			hosts = append(hosts, host)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", self.region, err)
+	}
+
+	self.setImageNames(hosts)
+
+	if len(hosts) > LargeResultSetWarning {
+		log.Printf("[WARNING] %d instances matched in %s; check the environment and cluster are what you meant\n",
+			len(hosts), self.region)
+	}
+
+	return hosts, nil
+}
+
+// setImageNames looks up the names of the hosts' AMIs, which SSH users may be
+// configured by. It's not an error if they can't be found, as the AMIs may
+// have been deregistered or belong to another account.
+func (self *EC2Inventory) setImageNames(hosts []*Host) {
+	imageIds := make([]*string, 0)
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if host.ImageId != "" && !seen[host.ImageId] {
+			seen[host.ImageId] = true
+			imageIds = append(imageIds, aws.String(host.ImageId))
+		}
+	}
+	if len(imageIds) == 0 {
+		return
+	}
+
+	resp, err := self.svc.DescribeImages(&ec2.DescribeImagesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("image-id"), Values: imageIds}},
+	})
+	if err != nil {
+		log.Printf("[WARNING] couldn't look up AMI names in %s: %s\n", self.region, err)
+		return
+	}
+
+	names := make(map[string]string, len(resp.Images))
+	for _, image := range resp.Images {
+		names[aws.StringValue(image.ImageId)] = aws.StringValue(image.Name)
+	}
+	for _, host := range hosts {
+		host.ImageName = names[host.ImageId]
+	}
+}
+
+// HostKeys gives the host keys an instance printed to its console on first
+// boot.
+func (self *EC2Inventory) HostKeys(host *Host) (keys []ssh.PublicKey, err error) {
+	resp, err := self.svc.GetConsoleOutput(&ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(host.Id),
+	})
+	if err != nil {
+		return
+	}
+
+	output, err := base64.StdEncoding.DecodeString(aws.StringValue(resp.Output))
+	if err != nil {
+		return
+	}
+	return parseConsoleHostKeys(output), nil
+}
+
+func hostFromInstance(i *ec2.Instance, tags TagSchema) *Host {
+	host := &Host{
+		Id:         aws.StringValue(i.InstanceId),
+		PublicDns:  aws.StringValue(i.PublicDnsName),
+		PublicIp:   aws.StringValue(i.PublicIpAddress),
+		PrivateDns: aws.StringValue(i.PrivateDnsName),
+		PrivateIp:  aws.StringValue(i.PrivateIpAddress),
+		KeyName:    aws.StringValue(i.KeyName),
+		ImageId:    aws.StringValue(i.ImageId),
+		Tags:       make(map[string]string, len(i.Tags)),
+		Instance:   i,
+	}
+	if i.Placement != nil {
+		host.AvailabilityZone = aws.StringValue(i.Placement.AvailabilityZone)
+	}
+	for _, tag := range i.Tags {
+		host.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	host.Name = host.Tags[tags.Name]
+	if host.Name == "" {
+		host.Name = host.Id
+	}
+	return host
+}
+
+func instanceFilters(tags TagSchema, project string, env string, cluster string, packageName string) (filters []*ec2.Filter) {
+	filters = make([]*ec2.Filter, 0)
+	filters = append(filters, &ec2.Filter{
+		Name: aws.String("instance-state-name"),
+		Values: []*string{
+			aws.String("running"),
+		},
+	})
+
+	if project != "" {
+		// Accept the same spellings of the project name that we accept for
+		// the AWS profile, so "My Project" matches a "my-project" tag.
+		projectValues := make([]*string, 0, 3)
+		for _, p := range getProfileKeys(project) {
+			projectValues = append(projectValues, aws.String(p))
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + tags.Project),
+			Values: projectValues,
+		})
+	}
+
+	queryEnv := env
+	if env == "" {
+		queryEnv = "*"
+	}
+	filters = append(filters, &ec2.Filter{
+		Name: aws.String("tag:" + tags.Environment),
+		Values: []*string{
+			aws.String(queryEnv),
+		},
+	})
+	if cluster != "" {
+		filters = append(filters, &ec2.Filter{
+			Name: aws.String("tag:" + tags.Cluster),
+			Values: []*string{
+				aws.String(cluster),
+			},
+		})
+	}
+
+	if packageName != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + tags.Packages),
+			Values: aws.StringSlice(tags.PackageFilterValues(packageName)),
+		})
+	}
+	return
+}
+
+// describeInstances calls fn with every reservation matching params, following
+// NextToken through all the pages.
+func describeInstances(svc *ec2.EC2, params *ec2.DescribeInstancesInput, fn func(*ec2.Reservation)) (err error) {
+	for {
+		var resp *ec2.DescribeInstancesOutput
+		resp, err = describeInstancesWithRetry(svc, params)
+		if err != nil {
+			return
+		}
+
+		for _, res := range resp.Reservations {
+			fn(res)
+		}
+
+		if resp.NextToken == nil || *resp.NextToken == "" {
+			return nil
+		}
+		params.NextToken = resp.NextToken
+	}
+}
+
+func describeInstancesWithRetry(svc *ec2.EC2, params *ec2.DescribeInstancesInput) (resp *ec2.DescribeInstancesOutput, err error) {
+	delay := DescribeInstancesRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err = svc.DescribeInstances(params)
+		if err == nil || !isThrottlingError(err) || attempt >= DescribeInstancesMaxRetries {
+			return
+		}
+		log.Printf("[WARNING] AWS is throttling requests; retrying in %s\n", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func isThrottlingError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+/// Several inventories at once
+
+// MultiInventory queries each of its inventories concurrently and merges
+// their hosts.
+type MultiInventory []Inventory
+
+func (self MultiInventory) Hosts(query InventoryQuery) (hosts []*Host, err error) {
+	type result struct {
+		hosts []*Host
+		err   error
+	}
+	results := make([]chan result, len(self))
+
+	for i, inventory := range self {
+		results[i] = make(chan result, 1)
+		go func(inventory Inventory, out chan result) {
+			hosts, err := inventory.Hosts(query)
+			out <- result{hosts: hosts, err: err}
+		}(inventory, results[i])
+	}
+
+	for _, out := range results {
+		r := <-out
+		if r.err != nil && err == nil {
+			err = r.err
+		}
+		hosts = append(hosts, r.hosts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+/// Hosts file
+
+// FileInventory reads hosts from a YAML or JSON file containing a list of
+// hosts. The file is parsed as JSON if its name ends in .json.
+type FileInventory struct {
+	Path string
+	Tags TagSchema
+}
+
+func (self *FileInventory) Hosts(query InventoryQuery) (hosts []*Host, err error) {
+	b, err := ioutil.ReadFile(self.Path)
+	if err != nil {
+		return
+	}
+
+	if strings.ToLower(filepath.Ext(self.Path)) == ".json" {
+		err = json.Unmarshal(b, &hosts)
+	} else {
+		err = yaml.Unmarshal(b, &hosts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse hosts file %s: %s", self.Path, err)
+	}
+
+	return filterHosts(hosts, self.Tags, query), nil
+}
+
+/// Hosts command
+
+// CommandInventory runs a shell command that prints a JSON list of hosts.
+// The query is passed to the command in MOLTAR_* environment variables so it
+// can narrow its output, but the hosts it returns are filtered again anyway.
+type CommandInventory struct {
+	Command string
+	Tags    TagSchema
+}
+
+func (self *CommandInventory) Hosts(query InventoryQuery) (hosts []*Host, err error) {
+	cmd := exec.Command("/bin/sh", "-c", self.Command)
+	cmd.Env = append(os.Environ(),
+		"MOLTAR_PROJECT="+query.Project,
+		"MOLTAR_ENV="+query.Env,
+		"MOLTAR_CLUSTER="+query.Cluster,
+		"MOLTAR_PACKAGE="+query.PackageName)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("hosts command failed: %s", err)
+	}
+
+	err = json.Unmarshal(out, &hosts)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse hosts command output: %s", err)
+	}
+
+	return filterHosts(hosts, self.Tags, query), nil
+}
+
+/// Local filtering, for inventories that can't filter for themselves
+
+func filterHosts(hosts []*Host, tags TagSchema, query InventoryQuery) (matches []*Host) {
+	matches = make([]*Host, 0, len(hosts))
+	for _, host := range hosts {
+		if host == nil {
+			continue
+		}
+		normaliseHost(host, tags)
+		if hostMatchesQuery(host, tags, query) {
+			matches = append(matches, host)
+		}
+	}
+	return
+}
+
+func normaliseHost(host *Host, tags TagSchema) {
+	if host.Tags == nil {
+		host.Tags = map[string]string{}
+	}
+	if host.Name == "" {
+		host.Name = host.Tags[tags.Name]
+	}
+	if host.Name == "" {
+		host.Name = host.Id
+	}
+	if host.Name == "" {
+		host.Name = host.Address("")
+	}
+	if host.Id == "" {
+		host.Id = host.Name
+	}
+}
+
+// hostMatchesQuery applies the same rules as the EC2 tag filters. Hosts
+// without a Project tag aren't filtered by project, as a hosts file is
+// usually specific to one project anyway.
+func hostMatchesQuery(host *Host, tags TagSchema, query InventoryQuery) bool {
+	if project, ok := host.Tags[tags.Project]; ok && query.Project != "" {
+		found := false
+		for _, p := range getProfileKeys(query.Project) {
+			if p == project {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	// As with the EC2 filter, hosts must have an environment, even if any
+	// will do.
+	if env, ok := host.Tags[tags.Environment]; !ok || (query.Env != "" && env != query.Env) {
+		return false
+	}
+	if query.Cluster != "" && host.Tags[tags.Cluster] != query.Cluster {
+		return false
+	}
+	if query.PackageName != "" &&
+		!tags.HasPackage(host.Tags[tags.Packages], query.PackageName) {
+		return false
+	}
+	return true
+}
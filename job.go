@@ -1,138 +1,111 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"golang.org/x/crypto/ssh"
 )
 
 var ErrNoInstancesFound = errors.New("No instances found; run provisioner first")
+var ErrNoBastionFound = errors.New("No bastion instance found")
+var ErrBatchAborted = errors.New("not run, as an earlier batch failed")
+var ErrConnectTimeout = errors.New("timed out connecting")
+var ErrCommandTimeout = errors.New("timed out running command")
+var ErrJobTimeout = errors.New("timed out, as the overall time limit was reached")
+var ErrInterrupted = errors.New("interrupted")
+
+const DefaultSshUser = "ubuntu"
 
 const AfterDeployHookScript = ".moltar-after-deploy"
 const FailedDeployHookScript = ".moltar-failed-deploy"
 
-type ExecError struct {
-	instance ec2.Instance
-	err      error
-}
-
-func (f ExecError) Error() string {
-	return fmt.Sprintf("%s : %s", instanceLogName(&f.instance), f.err)
+type ExecOptions struct {
+	// Parallel is the most instances to run on at once, or 0 for no limit.
+	Parallel int `json:"parallel,omitempty"`
+	// BatchSize is how many instances to run on before moving on to the
+	// next batch: a number, or a percentage such as "25%". Empty means all.
+	BatchSize string `json:"batch_size,omitempty"`
+	// BatchPause is how long to wait between batches.
+	BatchPause time.Duration `json:"batch_pause,omitempty"`
+	// CommandTimeout limits each command on each instance.
+	CommandTimeout time.Duration `json:"command_timeout,omitempty"`
+	// Timeout limits the whole run, over all instances and batches.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// NoTty stops a pty being requested, even if stdin is a terminal, so
+	// stdout and stderr are kept apart.
+	NoTty bool `json:"no_tty,omitempty"`
+	// Template expands exec commands and scp destinations as templates for
+	// each instance.
+	Template bool `json:"template,omitempty"`
 }
 
 type Job struct {
 	env                     string
 	cluster                 string
 	project                 string
+	config                  *Config
 	packageNames            []string
-	instances               []*ec2.Instance
-	instanceSshClients      map[*ec2.Instance]*ssh.Client
-	instanceLoggers         map[*ec2.Instance]*log.Logger
+	instances               []*Host
+	instanceSshClients      map[*Host]*pendingSshClient
+	instanceSshClientsLock  sync.Mutex
+	bastion                 *Host
+	bastionSshClient        *ssh.Client
+	bastionSshClientLock    sync.Mutex
+	hostKeys                *hostKeyChecker
+	sshConfig               *sshConfigFile
+	instanceLoggers         map[*Host]*log.Logger
+	instanceErrLoggers      map[*Host]*log.Logger
 	instanceLoggersLock     sync.Mutex
 	output                  io.Writer
+	errOutput               io.Writer
 	logger                  *log.Logger
+	outputFormat            string
+	execOutput              execOutput
 	installVersionRev       uint64
+	deadline                time.Time
+	interrupted             chan bool
+	interruptOnce           sync.Once
 	shouldOutputAnsiEscapes bool
 }
 
-func getInstancesTagged(svc *ec2.EC2, project string, env string, cluster string, packageName string) (instances []*ec2.Instance, err error) {
-	filters := make([]*ec2.Filter, 0)
-	filters = append(filters, &ec2.Filter{
-		Name: aws.String("instance-state-name"),
-		Values: []*string{
-			aws.String("running"),
-		},
-	})
-
-	filters = append(filters, &ec2.Filter{
-		Name: aws.String("instance-state-name"),
-		Values: []*string{
-			aws.String("running"),
-		},
-	})
-	queryEnv := env
-	if env == "" {
-		queryEnv = "*"
-	}
-	filters = append(filters, &ec2.Filter{
-		Name: aws.String("tag:Environment"),
-		Values: []*string{
-			aws.String(queryEnv),
-		},
-	})
-	if cluster != "" {
-		filters = append(filters, &ec2.Filter{
-			Name: aws.String("tag:Cluster"),
-			Values: []*string{
-				aws.String(cluster),
-			},
-		})
-	}
-
-	if packageName != "" {
-		filters = append(filters, &ec2.Filter{
-			Name: aws.String("tag:Packages"),
-			Values: []*string{
-				aws.String("*|" + packageName + "|*"),
-			},
-		})
-	}
-	params := &ec2.DescribeInstancesInput{
-		Filters: filters,
-	}
-
-	resp, err := svc.DescribeInstances(params)
-	if err != nil {
-		return
-	}
-
-	instances = make([]*ec2.Instance, 0, 20)
-	for _, res := range resp.Reservations {
-		for _, inst := range res.Instances {
-			newInst := inst
-			instances = append(instances, newInst)
-		}
-	}
-
-	return instances, nil
-}
-
-func NewJob(session *session.Session, env string, cluster string, project string, packageNames []string, searchPackageNames []string, output io.Writer, shouldOutputAnsiEscapes bool) (job *Job, err error) {
-	e := ec2.New(session)
-
+func NewJob(inventory Inventory, config *Config, env string, cluster string, project string, packageNames []string, searchPackageNames []string, output io.Writer, errOutput io.Writer, outputFormat string, shouldOutputAnsiEscapes bool) (job *Job, err error) {
 	if searchPackageNames == nil || len(searchPackageNames) == 0 {
 		searchPackageNames = []string{""}
 	}
 
-	instancesSet := map[string]*ec2.Instance{}
+	instancesSet := map[string]*Host{}
 	instancesCount := map[string]int{}
 	for _, packageName := range searchPackageNames {
-		instances, err := getInstancesTagged(e, project, env, cluster, packageName)
+		instances, err := inventory.Hosts(InventoryQuery{Project: project,
+			Env: env, Cluster: cluster, PackageName: packageName})
 		if err != nil {
 			return nil, err
 		}
 
 		for _, instance := range instances {
-			instancesSet[*instance.InstanceId] = instance
-			instancesCount[*instance.InstanceId] += 1
+			instancesSet[instance.Id] = instance
+			instancesCount[instance.Id] += 1
 		}
 	}
 
-	instances := make([]*ec2.Instance, 0, len(instancesSet))
+	instances := make([]*Host, 0, len(instancesSet))
 	for _, instance := range instancesSet {
-		if instancesCount[*instance.InstanceId] == len(searchPackageNames) {
+		if instancesCount[instance.Id] == len(searchPackageNames) {
 			instances = append(instances, instance)
 		}
 	}
@@ -140,73 +113,204 @@ func NewJob(session *session.Session, env string, cluster string, project string
 	if len(instances) == 0 {
 		return nil, ErrNoInstancesFound
 	}
+	// Sorted, so batches and template indexes are the same each time.
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Name != instances[j].Name {
+			return instances[i].Name < instances[j].Name
+		}
+		return instances[i].Id < instances[j].Id
+	})
+
+	sshConfig, err := loadSshConfig(defaultSshConfigFile())
+	if err != nil {
+		return nil, err
+	}
 
 	logger := log.New(output, "", 0)
 
-	return &Job{env: env, cluster: cluster,
-		project: project, packageNames: packageNames, instances: instances,
-		instanceSshClients: make(map[*ec2.Instance]*ssh.Client),
-		instanceLoggers:    make(map[*ec2.Instance]*log.Logger),
-		output:             output, logger: logger,
-		shouldOutputAnsiEscapes: shouldOutputAnsiEscapes}, nil
+	job = &Job{env: env, cluster: cluster,
+		project: project, config: config, packageNames: packageNames, instances: instances,
+		instanceSshClients: make(map[*Host]*pendingSshClient),
+		instanceLoggers:    make(map[*Host]*log.Logger),
+		instanceErrLoggers: make(map[*Host]*log.Logger),
+		hostKeys:           newHostKeyChecker(config.Ssh),
+		sshConfig:          sshConfig,
+		output:             output, errOutput: errOutput, logger: logger,
+		outputFormat: outputFormat, interrupted: make(chan bool),
+		shouldOutputAnsiEscapes: shouldOutputAnsiEscapes}
+	job.execOutput = newExecOutput(job, outputFormat)
+
+	if config.Ssh.Bastion != "" {
+		job.bastion, err = findBastion(inventory, config, project, env)
+		if err != nil {
+			return nil, err
+		}
+		job.excludeBastion()
+		if len(job.instances) == 0 {
+			return nil, ErrNoInstancesFound
+		}
+	}
+
+	return job, nil
 }
 
-func (self *Job) Exec(cmd string, series bool) (errs []error) {
-	execErrs := make([]ExecError, 0, len(self.instances))
-	if series {
-		execErrs = self.execInSeries(cmd)
-	} else {
-		execErrs = self.execInParallel(cmd)
+// findBastion resolves the configured bastion to a host. Bastions found in
+// the inventory are preferred if they're in the job's environment.
+func findBastion(inventory Inventory, config *Config, project string, env string) (bastion *Host, err error) {
+	spec := config.Ssh.Bastion
+	if !strings.Contains(spec, "=") {
+		bastion = &Host{}
+		if i := strings.LastIndex(spec, "@"); i != -1 {
+			bastion.SshUser = spec[:i]
+			spec = spec[i+1:]
+		}
+		if host, port, err := net.SplitHostPort(spec); err == nil {
+			bastion.PublicDns = host
+			bastion.Port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("bad bastion port in %s", config.Ssh.Bastion)
+			}
+		} else {
+			bastion.PublicDns = spec
+		}
+		bastion.Id = bastion.PublicDns
+		bastion.Name = bastion.PublicDns
+		return
+	}
+
+	hosts, err := inventory.Hosts(InventoryQuery{Project: project})
+	if err != nil {
+		return
 	}
-	if len(execErrs) > 0 {
-		for _, execErr := range execErrs {
-			errs = append(errs, execErr)
+	for _, host := range hosts {
+		if !matchCriteria(host, config.Tags, spec) {
+			continue
+		}
+		if bastion == nil || host.Tags[config.Tags.Environment] == env {
+			bastion = host
 		}
 	}
+	if bastion == nil {
+		return nil, ErrNoBastionFound
+	}
 	return
 }
 
-func (self *Job) Deploy(runHooks bool, series bool, version string) (errs []error) {
-	execErrs := make([]ExecError, 0, len(self.instances))
-	execErrs = self.execList(self.makeInstallCommands(version), series)
+// excludeBastion removes the bastion from the job's instances, unless its
+// cluster was asked for.
+func (self *Job) excludeBastion() {
+	if self.cluster != "" && self.bastion.Tags[self.config.Tags.Cluster] == self.cluster {
+		return
+	}
+	instances := make([]*Host, 0, len(self.instances))
+	for _, instance := range self.instances {
+		if instance.Id != self.bastion.Id {
+			instances = append(instances, instance)
+		}
+	}
+	self.instances = instances
+}
 
-	hosts := make([]string, 0, len(execErrs))
-	for _, execErr := range execErrs {
-		hosts = append(hosts, *execErr.instance.PublicDnsName)
-		errs = append(errs, execErr.err)
+func (self *Job) Exec(cmd string, opts ExecOptions) (results []*ExecResult, err error) {
+	cmdFunc := fixedCommand(cmd)
+	if opts.Template {
+		if cmdFunc, err = templateCommand(cmd); err != nil {
+			return
+		}
 	}
 
-	if runHooks {
-		var err error
-		if _, err := os.Stat(FailedDeployHookScript); len(execErrs) > 0 && err == nil {
-			fmt.Println(getHookMessage(FailedDeployHookScript))
+	var stdin stdinSource
+	if !StdinIsTerminal() {
+		// Stdin can only be streamed if every instance runs at once.
+		count := len(self.instances)
+		size, _ := parseBatchSize(opts.BatchSize, count)
+		streaming := (opts.Parallel <= 0 || opts.Parallel >= count) && size >= count
+		stdin = newStdinSource(os.Stdin, count, streaming)
+	}
+
+	results, err = self.execBatches(opts, func(batch []*Host) []*ExecResult {
+		return self.execOn(batch, cmdFunc, opts, stdin)
+	})
+	return
+}
+
+// Deploy installs the job's packages, giving the result on each instance, and
+// the error from running a deploy hook, if any.
+func (self *Job) Deploy(runHooks bool, version string, opts ExecOptions) (results []*ExecResult, err error) {
+	description, cmds := self.makeInstallCommands(version)
+	self.execOutput.Message(description)
+	results, err = self.execBatches(opts, func(batch []*Host) []*ExecResult {
+		return self.execList(cmds, batch, opts)
+	})
+	if err != nil {
+		return
+	}
+
+	failed := failedResults(results)
+	hosts := make([]string, 0, len(failed))
+	for _, result := range failed {
+		hosts = append(hosts, self.instanceAddress(result.Host))
+	}
+
+	if runHooks && self.isInterrupted() {
+		self.execOutput.Message("Interrupted, so not running deploy hooks")
+	} else if runHooks {
+		if _, statErr := os.Stat(FailedDeployHookScript); len(failed) > 0 && statErr == nil {
+			self.execOutput.Message(getHookMessage(FailedDeployHookScript))
 			err = self.runHook(FailedDeployHookScript,
 				[]string{"FAILED_HOSTS=" + strings.Join(hosts, " ")})
-		} else if _, err := os.Stat(AfterDeployHookScript); err == nil {
-			fmt.Println(getHookMessage(AfterDeployHookScript))
+		} else if _, statErr := os.Stat(AfterDeployHookScript); statErr == nil {
+			self.execOutput.Message(getHookMessage(AfterDeployHookScript))
 			err = self.runHook(AfterDeployHookScript, nil)
 		}
-		if err != nil {
-			errs = append(errs, err)
-		}
 	}
 	return
 }
 
+// WriteOutputTo saves each instance's output and result to files in dir, as
+// well as printing them.
+func (self *Job) WriteOutputTo(dir string) (err error) {
+	output, err := newFileOutput(self.execOutput, dir, self.instances)
+	if err != nil {
+		return
+	}
+	self.execOutput = output
+	return
+}
+
+// Interrupt stops the commands running on instances, and those yet to be run.
+func (self *Job) Interrupt() {
+	self.interruptOnce.Do(func() { close(self.interrupted) })
+}
+
+func (self *Job) isInterrupted() bool {
+	select {
+	case <-self.interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// PrintResults prints a summary of the results of Exec or Deploy.
+func (self *Job) PrintResults(results []*ExecResult) {
+	self.execOutput.Results(results)
+}
+
 func (self *Job) Ssh(criteria string, sshArgs []string) (err error) {
 	sshPath, err := exec.LookPath("ssh")
 	if err != nil {
 		return
 	}
 
-	var instance *ec2.Instance
+	var instance *Host
 	matches := self.instances
 
 	if criteria != "-1" {
 		if criteria != "" {
-			matches = make([]*ec2.Instance, 0, len(self.instances))
+			matches = make([]*Host, 0, len(self.instances))
 			for _, instance = range self.instances {
-				if matchCriteria(instance, criteria) {
+				if matchCriteria(instance, self.config.Tags, criteria) {
 					instanceLogName(instance)
 					matches = append(matches, instance)
 				}
@@ -224,9 +328,28 @@ func (self *Job) Ssh(criteria string, sshArgs []string) (err error) {
 
 	instance = matches[0]
 
+	err = self.hostKeys.LearnFromSource(instance, self.instanceHostPort(instance))
+	if err != nil {
+		return
+	}
+
 	execArgs := []string{"ssh"}
+	execArgs = append(execArgs, self.sshOptions(instance)...)
+	for _, fn := range self.explicitIdentityFiles(instance) {
+		execArgs = append(execArgs, "-i", fn)
+	}
+	if instance.Port != 0 {
+		execArgs = append(execArgs, "-p", strconv.Itoa(instance.Port))
+	}
+	if self.bastion != nil {
+		err = self.hostKeys.LearnFromSource(self.bastion, self.instanceHostPort(self.bastion))
+		if err != nil {
+			return
+		}
+		execArgs = append(execArgs, "-o", "ProxyCommand="+self.proxyCommand())
+	}
 	execArgs = append(execArgs,
-		fmt.Sprintf("%s@%s", self.sshUserName(instance), *instance.PublicDnsName))
+		fmt.Sprintf("%s@%s", self.sshUserName(instance), self.instanceAddress(instance)))
 	execArgs = append(execArgs, sshArgs...)
 
 	fPrintShellCommand(self.output, "", execArgs)
@@ -237,92 +360,15 @@ func (self *Job) Ssh(criteria string, sshArgs []string) (err error) {
 	return
 }
 
-func (self *Job) Scp(args []string) (err error) {
-	scpPath, err := exec.LookPath("scp")
-	if err != nil {
-		return
-	}
-
-	defaultArgs := []string{"-q"}
-	scpArgs := make([]string, len(defaultArgs)+len(args))
-	copy(scpArgs, defaultArgs)
-	copy(scpArgs[len(defaultArgs):], args)
-
-	var dstIndex = -1
-	for i, arg := range scpArgs {
-		if arg[0] == ':' {
-			dstIndex = i
-			break
-		}
-	}
-	if dstIndex == -1 {
-		dstIndex = len(scpArgs)
-		scpArgs = append(scpArgs, ":")
-	}
-
-	errChan := make(chan error, len(self.instances))
-
-	for _, instance := range self.instances {
-		go func(instance *ec2.Instance) {
-			var err error
-			args := make([]string, len(scpArgs))
-			copy(args, scpArgs)
-
-			logger := self.instanceLogger(instance)
-			args[dstIndex] = fmt.Sprintf("%s@%s%s",
-				self.sshUserName(instance), *instance.PublicDnsName, args[dstIndex])
-
-			fPrintShellCommand(self.output, "scp", args)
-
-			cmd := exec.Command(scpPath, args...)
-			outPipeRead, outPipeWrite, err := os.Pipe()
-			if err != nil {
-				logger.Printf("error creating pipe: %s\n", err)
-				errChan <- err
-				return
-			}
-			cmd.Stdout = outPipeWrite
-			cmd.Stderr = outPipeWrite
-
-			err = cmd.Start()
-			if err != nil {
-				logger.Printf("error starting scp: %s\n", err)
-				errChan <- err
-				return
-			}
-
-			outPipeWrite.Close()
-			stdoutReader := bufio.NewReader(outPipeRead)
-			for {
-				in, err := stdoutReader.ReadString('\n')
-				if (err == io.EOF && in != "") || err == nil {
-					logger.Print(in)
-				}
-				if err != nil {
-					break
-				}
-			}
-
-			err = cmd.Wait()
-			outPipeRead.Close()
-			if err != nil {
-				logger.Printf("error running scp: %s\n", err)
-			}
-			errChan <- err
-		}(instance)
-	}
-
-	var scpErr error
-	for _ = range self.instances {
-		scpErr = <-errChan
-		if err == nil && scpErr != nil {
-			err = errors.New("at least one scp failed")
+func (self *Job) List() (err error) {
+	if self.outputFormat == OutputJson {
+		hosts := make([]jsonHost, len(self.instances))
+		for i, instance := range self.instances {
+			hosts[i] = jsonHost{Host: instance, Address: self.instanceAddress(instance)}
 		}
+		return json.NewEncoder(self.output).Encode(hosts)
 	}
-	return
-}
 
-func (self *Job) List() (err error) {
 	self.printInstances(self.instances)
 	return nil
 }
@@ -330,7 +376,11 @@ func (self *Job) List() (err error) {
 func (self *Job) Hostname(instanceName string) (err error) {
 	for _, instance := range self.instances {
 		if instanceLogName(instance) == instanceName {
-			fmt.Fprintln(self.output, *instance.PublicDnsName)
+			if self.outputFormat == OutputJson {
+				return json.NewEncoder(self.output).Encode(
+					jsonHost{Host: instance, Address: self.instanceAddress(instance)})
+			}
+			fmt.Fprintln(self.output, self.instanceAddress(instance))
 			return nil
 		}
 	}
@@ -339,155 +389,560 @@ func (self *Job) Hostname(instanceName string) (err error) {
 
 /// Subtasks
 
-func (self *Job) sshClient(i *ec2.Instance) (conn *ssh.Client, err error) {
-	conn = self.instanceSshClients[i]
-	if conn == nil {
-		conn, err = self.sshDial(i)
-		if err == nil {
-			self.instanceSshClients[i] = conn
-		}
+// pendingSshClient is a connection to an instance, which is ready once done is
+// closed.
+type pendingSshClient struct {
+	done chan bool
+	conn *ssh.Client
+	err  error
+}
+
+// sshClient gives the connection to instance, connecting if need be. The
+// lock is only held to look it up, so instances are connected to in
+// parallel, but if another caller is already connecting to the same
+// instance, its connection is waited for. A failed connection isn't kept,
+// so a later call tries again.
+func (self *Job) sshClient(i *Host) (conn *ssh.Client, err error) {
+	self.instanceSshClientsLock.Lock()
+	pending := self.instanceSshClients[i]
+	if pending != nil {
+		self.instanceSshClientsLock.Unlock()
+		<-pending.done
+		return pending.conn, pending.err
 	}
-	return
+	pending = &pendingSshClient{done: make(chan bool)}
+	self.instanceSshClients[i] = pending
+	self.instanceSshClientsLock.Unlock()
+
+	pending.conn, pending.err = self.sshDial(i)
+	if pending.err != nil {
+		self.instanceSshClientsLock.Lock()
+		delete(self.instanceSshClients, i)
+		self.instanceSshClientsLock.Unlock()
+	}
+	close(pending.done)
+	return pending.conn, pending.err
 }
 
-func (self *Job) instanceLogger(i *ec2.Instance) (logger *log.Logger) {
+func (self *Job) instanceLogger(i *Host) (logger *log.Logger) {
 	self.instanceLoggersLock.Lock()
 	defer self.instanceLoggersLock.Unlock()
 	logger = self.instanceLoggers[i]
 	if logger == nil {
-		prefix := instanceLogName(i)
-		if self.shouldOutputAnsiEscapes {
-			prefix = "\033[1m" + prefix + "\033[0m"
-		}
-		logger = log.New(self.output, prefix+" ", 0)
+		logger = self.newInstanceLogger(i, self.output, self.shouldOutputAnsiEscapes, "\033[1m")
 		self.instanceLoggers[i] = logger
 	}
 	return
 }
 
-func (self *Job) exec(instance ec2.Instance, cmd string, errChan chan ExecError) {
-	conn, err := self.sshClient(&instance)
-	if err != nil {
-		errChan <- ExecError{err: err, instance: instance}
+// instanceErrLogger is for the instance's stderr, which goes to moltar's
+// stderr, and is marked in red on a terminal.
+func (self *Job) instanceErrLogger(i *Host) (logger *log.Logger) {
+	self.instanceLoggersLock.Lock()
+	defer self.instanceLoggersLock.Unlock()
+	logger = self.instanceErrLoggers[i]
+	if logger == nil {
+		logger = self.newInstanceLogger(i, self.errOutput, isTerminal(self.errOutput), "\033[1;31m")
+		self.instanceErrLoggers[i] = logger
+	}
+	return
+}
+
+func (self *Job) newInstanceLogger(i *Host, w io.Writer, ansiEscapes bool, style string) *log.Logger {
+	prefix := instanceLogName(i)
+	if self.hasMultipleTargets() {
+		prefix += " (" + instanceTargetName(i) + ")"
+	}
+	if ansiEscapes {
+		prefix = style + prefix + "\033[0m"
+	}
+	return log.New(w, prefix+" ", 0)
+}
+
+// exec runs cmd on instance, giving it a copy of stdin if that isn't nil.
+func (self *Job) exec(instance *Host, cmd string, opts ExecOptions, stdin stdinSource) (result *ExecResult) {
+	result = newExecResult(instance)
+	start := time.Now()
+	var stdinReader io.ReadCloser
+	defer func() {
+		if stdinReader != nil {
+			stdinReader.Close()
+		} else if stdin != nil {
+			stdin.Skip()
+		}
+		result.Duration = time.Since(start)
+	}()
+
+	conn, ok := self.connect(instance, result)
+	if !ok {
 		return
 	}
 
-	logger := self.instanceLogger(&instance)
-	var stdinChannel chan []byte
-	if !StdinIsTerminal() {
-		stdinChannel = makeStdinChannel()
+	var err error
+
+	if stdin != nil {
+		if stdinReader, err = stdin.Open(); err != nil {
+			result.Err = err
+			return
+		}
 	}
 
-	_, returnChan, err := sshRunOutLogger(conn, cmd, logger, stdinChannel)
+	output := func(stream string, data []byte) {
+		self.execOutput.Output(instance, stream, data)
+	}
+
+	var stats sshRunStats
+	pty := StdinIsTerminal() && !opts.NoTty
+	var stdinR io.Reader
+	if stdinReader != nil {
+		stdinR = stdinReader
+	}
+	term, returnChan, err := sshRunOutLogger(conn, cmd, pty, output, stdinR, &stats)
 	if err == nil {
-		StartStdinRead()
-		err = <-returnChan
+		err = self.waitForCommand(term, returnChan, opts.CommandTimeout)
 	}
-	errChan <- ExecError{err: err, instance: instance}
+	result.setErr(err)
+	result.Interrupted = err == ErrInterrupted
+	result.BytesOut = atomic.LoadInt64(&stats.BytesOut)
+	result.BytesErr = atomic.LoadInt64(&stats.BytesErr)
 	return
 }
 
-func (self *Job) execInSeries(cmd string) (errs []ExecError) {
-	errChan := make(chan ExecError, len(self.instances))
-	go WaitForStdinStart(len(self.instances))
-	errs = make([]ExecError, 0, len(self.instances))
+// connect gives the connection to instance, unless the job is past its
+// deadline or has been interrupted. The deadline also limits connecting. If
+// it doesn't, the reason is recorded in result.
+func (self *Job) connect(instance *Host, result *ExecResult) (conn *ssh.Client, ok bool) {
+	if self.pastDeadline() {
+		result.Err = ErrJobTimeout
+		result.NotRun = true
+		return nil, false
+	}
+	if self.isInterrupted() {
+		result.Err = ErrInterrupted
+		result.NotRun = true
+		return nil, false
+	}
 
-	for _, instance := range self.instances {
-		self.exec(*instance, cmd, errChan)
+	conn, err := self.sshClient(instance)
+	if err != nil {
+		result.Err = err
+		// Running out of time while connecting is a timeout, like running
+		// out while the command runs, rather than the instance being down.
+		result.Unreachable = err != ErrJobTimeout
+		return nil, false
 	}
+	return conn, true
+}
 
-	for _ = range self.instances {
-		if err := <-errChan; err.err != nil {
-			errs = append(errs, err)
+// waitForCommand waits for a command started by sshRunOutLogger to finish. If
+// it runs for longer than timeout, or past the job's deadline, or the job is
+// interrupted, its session is terminated and an error returned.
+func (self *Job) waitForCommand(term chan bool, returnChan chan error, timeout time.Duration) error {
+	timeoutErr := ErrCommandTimeout
+	if !self.deadline.IsZero() {
+		if untilDeadline := time.Until(self.deadline); timeout == 0 || untilDeadline < timeout {
+			timeout, timeoutErr = untilDeadline, ErrJobTimeout
 		}
 	}
+
+	// A nil channel never fires, so without a timeout only the others count.
+	var timerChan <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timerChan = timer.C
+	}
+	var err error
+	select {
+	case err = <-returnChan:
+		return err
+	case <-timerChan:
+		err = timeoutErr
+	case <-self.interrupted:
+		err = ErrInterrupted
+	}
+	// Wait for the session to be closed, so the command isn't left running.
+	term <- true
+	<-returnChan
+	return err
+}
+
+func (self *Job) pastDeadline() bool {
+	return !self.deadline.IsZero() && time.Now().After(self.deadline)
+}
+
+// execOn runs the command cmd gives for each of instances on it, at most
+// opts.Parallel at a time, or all at once if that's 0. Each is given a copy of
+// stdin if that isn't nil.
+func (self *Job) execOn(instances []*Host, cmd commandFunc, opts ExecOptions, stdin stdinSource) (results []*ExecResult) {
+	if !StdinIsTerminal() && !opts.NoTty {
+		self.execOutput.Message("[WARNING] pty not requested because stdin is not a terminal")
+	}
+	return self.runOn(instances, opts, func(instance *Host, index int) *ExecResult {
+		instanceCmd, err := cmd(instance, index)
+		if err != nil {
+			if stdin != nil {
+				stdin.Skip()
+			}
+			result := newExecResult(instance)
+			result.Err = err
+			return result
+		}
+		return self.exec(instance, instanceCmd, opts, stdin)
+	})
+}
+
+// runOn calls fn for each of instances, with its index, at most
+// opts.Parallel at a time, or all at once if that's 0.
+func (self *Job) runOn(instances []*Host, opts ExecOptions, fn func(*Host, int) *ExecResult) (results []*ExecResult) {
+	resultChan := make(chan *ExecResult, len(instances))
+	results = make([]*ExecResult, 0, len(instances))
+
+	parallel := opts.Parallel
+	if parallel <= 0 || parallel > len(instances) {
+		parallel = len(instances)
+	}
+	slots := make(chan bool, parallel)
+
+	for i, instance := range instances {
+		slots <- true
+		go func(inst *Host, index int) {
+			defer func() { <-slots }()
+			resultChan <- fn(inst, index)
+		}(instance, i)
+	}
+
+	for _ = range instances {
+		results = append(results, <-resultChan)
+	}
 	return
 }
 
-func (self *Job) execInParallel(cmd string) (errs []ExecError) {
-	errChan := make(chan ExecError, len(self.instances))
-	go WaitForStdinStart(len(self.instances))
-	errs = make([]ExecError, 0, len(self.instances))
+// execBatches splits the instances into batches as opts gives, and calls fn
+// with each in turn. If a batch fails, the instances in later batches are
+// reported as not run.
+func (self *Job) execBatches(opts ExecOptions, fn func([]*Host) []*ExecResult) (results []*ExecResult, err error) {
+	size, err := parseBatchSize(opts.BatchSize, len(self.instances))
+	if err != nil {
+		return
+	}
+
+	if opts.Timeout > 0 {
+		self.deadline = time.Now().Add(opts.Timeout)
+	}
 
-	for _, instance := range self.instances {
-		go func(inst ec2.Instance) {
-			self.exec(inst, cmd, errChan)
-		}(*instance)
+	batches := make([][]*Host, 0, len(self.instances)/size+1)
+	for start := 0; start < len(self.instances); start += size {
+		end := start + size
+		if end > len(self.instances) {
+			end = len(self.instances)
+		}
+		batches = append(batches, self.instances[start:end])
 	}
 
-	for _ = range self.instances {
-		if err := <-errChan; err.err != nil {
-			errs = append(errs, err)
+	for n, batch := range batches {
+		if len(batches) > 1 {
+			if n > 0 && opts.BatchPause > 0 {
+				self.execOutput.Message(fmt.Sprintf("\nWaiting %s before the next batch", opts.BatchPause))
+				select {
+				case <-time.After(opts.BatchPause):
+				case <-self.interrupted:
+				}
+			}
+			self.execOutput.Message(fmt.Sprintf("\nBatch %d of %d (%d instances)", n+1, len(batches), len(batch)))
+		}
+
+		batchResults := fn(batch)
+		results = append(results, batchResults...)
+		failed := len(failedResults(batchResults)) > 0
+		if failed || (n < len(batches)-1 && (self.pastDeadline() || self.isInterrupted())) {
+			abortErr := ErrBatchAborted
+			if self.isInterrupted() {
+				abortErr = ErrInterrupted
+			} else if !failed {
+				abortErr = ErrJobTimeout
+			}
+			for _, later := range batches[n+1:] {
+				for _, instance := range later {
+					result := newExecResult(instance)
+					result.Err = abortErr
+					result.NotRun = true
+					results = append(results, result)
+				}
+			}
+			return
 		}
 	}
 	return
 }
 
-func (self *Job) makeInstallCommands(version string) (commands []string) {
+// parseBatchSize parses a batch size, either a number of instances or a
+// percentage of total. An empty spec means all of them.
+func parseBatchSize(spec string, total int) (size int, err error) {
+	if spec == "" {
+		spec = strconv.Itoa(total)
+	}
+
+	if strings.HasSuffix(spec, "%") {
+		var percent float64
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(spec, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("bad batch size %s", spec)
+		}
+		size = int(math.Ceil(float64(total) * percent / 100))
+	} else {
+		size, err = strconv.Atoi(spec)
+		if err != nil || size <= 0 {
+			return 0, fmt.Errorf("bad batch size %s", spec)
+		}
+	}
+
+	if size < 1 {
+		size = 1
+	}
+	return size, nil
+}
+
+// makeInstallCommands gives the commands to install the job's packages, and
+// a description of what they'll do.
+func (self *Job) makeInstallCommands(version string) (description string, commands []string) {
 	if version == "" {
 		// no version specified, we'll just install
 		packages := "'" + strings.Join(self.packageNames, "' '") + "'"
 
-		fmt.Printf("Installing packages: " + packages)
+		description = "Installing packages: " + packages
 		commands = []string{
 			"sudo apt-get update -qq",
 			"sudo DEBIAN_FRONTEND=noninteractive apt-get install -qy " + packages,
 			"sudo DEBIAN_FRONTEND=noninteractive apt-get autoremove -yq",
 			"sudo apt-get clean -yq",
 		}
-		return commands
-	} else {
-		packages := ""
-		for _, v := range self.packageNames {
-			packages += " '" + v + "=" + version + "'"
+		return
+	}
+
+	packages := ""
+	for _, v := range self.packageNames {
+		packages += " '" + v + "=" + version + "'"
+	}
+	description = "Force installing packages:" + packages
+	commands = []string{
+		"sudo apt-get update -qq",
+		"sudo DEBIAN_FRONTEND=noninteractive apt-get install -qy --force-yes" + packages,
+		"sudo DEBIAN_FRONTEND=noninteractive apt-get autoremove -yq",
+		"sudo apt-get clean -yq",
+	}
+	return
+}
+
+// execList runs each of cmds in turn on instances, stopping if any fail. The
+// results of each command on an instance are added together.
+func (self *Job) execList(cmds []string, instances []*Host, opts ExecOptions) (results []*ExecResult) {
+	byHost := make(map[*Host]*ExecResult, len(instances))
+	for _, instance := range instances {
+		byHost[instance] = newExecResult(instance)
+	}
+
+	for _, cmd := range cmds {
+		self.execOutput.Message(fmt.Sprintf("\n%s\n", cmd))
+		cmdResults := self.execOn(instances, fixedCommand(cmd), opts, nil)
+		for _, result := range cmdResults {
+			byHost[result.Host].add(result)
 		}
-		fmt.Printf("Force installing packages: " + packages)
-		commands = []string{
-			"sudo apt-get update -qq",
-			"sudo DEBIAN_FRONTEND=noninteractive apt-get install -qy --force-yes" + packages,
-			"sudo DEBIAN_FRONTEND=noninteractive apt-get autoremove -yq",
-			"sudo apt-get clean -yq",
+		if len(failedResults(cmdResults)) > 0 {
+			for _, result := range cmdResults {
+				if result.OK() {
+					byHost[result.Host].Err = ErrLaterCommandsNotRun
+					byHost[result.Host].Incomplete = true
+				}
+			}
+			break
 		}
-		return commands
 	}
 
-	return []string{}
+	results = make([]*ExecResult, 0, len(instances))
+	for _, instance := range instances {
+		results = append(results, byHost[instance])
+	}
+	return
 }
 
-func (self *Job) execList(cmds []string, series bool) (errs []ExecError) {
-	for _, cmd := range cmds {
-		fmt.Printf("\n%s\n\n", cmd)
-		if series {
-			errs = self.execInSeries(cmd)
-		} else {
-			errs = self.execInParallel(cmd)
+// sshUserName gives the user to connect to an instance as. In order, it's
+// taken from the inventory, the instance's SshUser tag, the [users] AMI rules,
+// the ssh config, and the [ssh] default.
+func (self *Job) sshUserName(i *Host) (userName string) {
+	if i.SshUser != "" {
+		return i.SshUser
+	}
+	if userName = i.Tags[self.config.Tags.SshUser]; userName != "" {
+		return
+	}
+	for _, rule := range self.config.Users {
+		if rule.Matches(i.ImageId, i.ImageName) {
+			return rule.User
 		}
-		if len(errs) > 0 {
+	}
+	if userName = self.sshConfig.Get("User", self.sshConfigNames(i)...); userName != "" {
+		return
+	}
+	if self.config.Ssh.User != "" {
+		return self.config.Ssh.User
+	}
+	return DefaultSshUser
+}
+
+func (self *Job) sshDial(i *Host) (conn *ssh.Client, err error) {
+	via, err := self.bastionClient()
+	if err == ErrJobTimeout {
+		return
+	} else if err != nil {
+		return nil, fmt.Errorf("bastion %s: %s", instanceLogName(self.bastion), err)
+	}
+	config, err := self.sshClientConfig(i)
+	if err != nil {
+		return
+	}
+	conn, err = sshDialRetrying(self.instanceHostPort(i), config, via,
+		self.config.Ssh.ConnectRetries, self.deadline)
+	if isTimeoutError(err) {
+		err = ErrConnectTimeout
+	}
+	return
+}
+
+// sshClientConfig gives the config to connect to an instance with. Keys are
+// loaded, asking for passphrases if need be, and host keys fetched from the
+// inventory beforehand, so that the connect timeout doesn't include them.
+func (self *Job) sshClientConfig(i *Host) (config *ssh.ClientConfig, err error) {
+	fallbackFiles := self.sshConfig.GetAll("IdentityFile", self.sshConfigNames(i)...)
+	fallbackFiles = append(fallbackFiles, defaultIdentityFiles...)
+
+	signers, err := sshSigners(self.explicitIdentityFiles(i), fallbackFiles)
+	if err != nil {
+		return
+	}
+	if err = self.hostKeys.Prepare(i, self.instanceHostPort(i)); err != nil {
+		return
+	}
+	algorithms, err := self.hostKeys.Algorithms(self.instanceHostPort(i))
+	if err != nil {
+		return
+	}
+
+	return &ssh.ClientConfig{
+		User: self.sshUserName(i),
+		// The keys are all offered by one method, as the client only tries
+		// each kind of method once.
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   self.hostKeys.Callback(i),
+		HostKeyAlgorithms: algorithms,
+		Timeout:           self.config.Ssh.ConnectTimeout,
+	}, nil
+}
+
+// explicitIdentityFiles are the keys configured for moltar, as opposed to
+// those in the ssh config, which external ssh commands find themselves.
+func (self *Job) explicitIdentityFiles(i *Host) (files []string) {
+	if self.config.Ssh.IdentityFile != "" {
+		files = append(files, expandHome(self.config.Ssh.IdentityFile))
+	}
+	if fn := self.config.Keys[i.KeyName]; i.KeyName != "" && fn != "" {
+		files = append(files, expandHome(fn))
+	}
+	return
+}
+
+// sshConfigNames are the names ssh config Host patterns are matched against.
+func (self *Job) sshConfigNames(i *Host) []string {
+	return []string{self.instanceAddress(i), i.Name}
+}
+
+func (self *Job) instancePort(i *Host) int {
+	if i.Port != 0 {
+		return i.Port
+	}
+	if port, err := strconv.Atoi(self.sshConfig.Get("Port", self.sshConfigNames(i)...)); err == nil {
+		return port
+	}
+	return 22
+}
+
+func (self *Job) instanceHostPort(i *Host) string {
+	return net.JoinHostPort(self.instanceAddress(i), strconv.Itoa(self.instancePort(i)))
+}
+
+// bastionClient gives the connection to tunnel instance connections through,
+// or nil if there's no bastion.
+func (self *Job) bastionClient() (conn *ssh.Client, err error) {
+	if self.bastion == nil {
+		return nil, nil
+	}
+
+	self.bastionSshClientLock.Lock()
+	defer self.bastionSshClientLock.Unlock()
+	if self.bastionSshClient == nil {
+		var config *ssh.ClientConfig
+		if config, err = self.sshClientConfig(self.bastion); err != nil {
 			return
 		}
+		self.bastionSshClient, err = sshDialRetrying(self.instanceHostPort(self.bastion),
+			config, nil, self.config.Ssh.ConnectRetries, self.deadline)
 	}
-	return []ExecError{}
+	return self.bastionSshClient, err
 }
 
-func (self *Job) sshUserName(_ *ec2.Instance) (userName string) {
-	// TODO: be more clever about this
-	return "ubuntu"
+// proxyCommand gives the ssh command to reach instances through the bastion.
+// It's used rather than -J, which doesn't pass on the known_hosts options.
+func (self *Job) proxyCommand() string {
+	args := []string{"ssh"}
+	args = append(args, self.sshOptions(self.bastion)...)
+	for _, fn := range self.explicitIdentityFiles(self.bastion) {
+		args = append(args, "-i", fn)
+	}
+	args = append(args, "-p", strconv.Itoa(self.instancePort(self.bastion)), "-W", "%h:%p",
+		fmt.Sprintf("%s@%s", self.sshUserName(self.bastion), self.instanceAddress(self.bastion)))
+
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	return strings.Join(args, " ")
 }
 
-func (self *Job) sshDial(i *ec2.Instance) (conn *ssh.Client, err error) {
-	conn, err = sshDial(*i.PublicDnsName+":22", self.sshUserName(i))
+// sshOptions are the options given to external ssh commands to host.
+func (self *Job) sshOptions(host *Host) (opts []string) {
+	opts = self.hostKeys.SshOptions(host)
+	if timeout := self.config.Ssh.ConnectTimeout; timeout > 0 {
+		opts = append(opts, "-o", fmt.Sprintf("ConnectTimeout=%d", int(math.Ceil(timeout.Seconds()))))
+	}
 	return
 }
 
-func (self *Job) printInstances(instances []*ec2.Instance) {
+func (self *Job) instanceAddress(i *Host) string {
+	if i == self.bastion {
+		// The bastion is always reached by its public address.
+		return i.Address("")
+	}
+	return i.Address(self.config.Ssh.Address)
+}
+
+func (self *Job) printInstances(instances []*Host) {
+	tags := self.config.Tags
 	fields := make([][]string, len(instances))
 	for i, instance := range instances {
-		fields[i] = []string{*instance.InstanceId, instanceLogName(instance),
-			*instance.PublicDnsName}
+		fields[i] = []string{instance.Id, instanceLogName(instance),
+			instance.Tags[tags.Project], instance.Tags[tags.Environment],
+			instance.Tags[tags.Cluster]}
+		if self.hasMultipleTargets() {
+			fields[i] = append(fields[i], instance.Region, instance.Account)
+		}
+		fields[i] = append(fields[i], self.instanceAddress(instance))
 	}
 	fmt.Fprint(self.output, formatTable(fields))
 }
 
+func (self *Job) hasMultipleTargets() bool {
+	return len(self.config.Targets) > 1
+}
+
 func (self *Job) runHook(scriptPath string, environment []string) error {
 	vars := make([]string, 0, len(os.Environ())+len(environment)+1)
 	vars = append(vars, "ENV="+self.env)
@@ -500,17 +955,28 @@ func (self *Job) runHook(scriptPath string, environment []string) error {
 	cmd := exec.Command("./" + scriptPath)
 	cmd.Env = vars
 	cmd.Stdout = os.Stdout
+	if self.outputFormat == OutputJson {
+		// Keep stdout to moltar's own output.
+		cmd.Stdout = os.Stderr
+	}
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-func instanceLogName(i *ec2.Instance) string {
-	for _, tag := range i.Tags {
-		if *tag.Key == "Name" && *tag.Value != "" {
-			return *tag.Value
-		}
+func instanceLogName(i *Host) string {
+	return i.Name
+}
+
+func instanceTargetName(i *Host) string {
+	if i.Account == "" {
+		return i.Region
 	}
-	return *i.InstanceId
+	return i.Region + "/" + i.Account
+}
+
+// shellQuote quotes s as a single word for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
 
 func fPrintShellCommand(w io.Writer, n string, cmd []string) {
@@ -531,17 +997,34 @@ func fPrintShellCommand(w io.Writer, n string, cmd []string) {
 	fmt.Fprint(w, "\n")
 }
 
-func matchCriteria(instance *ec2.Instance, criteria string) bool {
+// matchCriteria matches each slash-separated part of criteria against the
+// instance's tags, ID and DNS names. A part of the form KEY=VALUE only
+// matches the tag KEY, where KEY may be a tag schema concept such as 'env'.
+func matchCriteria(instance *Host, tags TagSchema, criteria string) bool {
 	var found bool
 	for _, value := range strings.Split(criteria, "/") {
+		if kv := strings.SplitN(value, "=", 2); len(kv) == 2 {
+			key := tags.TagKey(kv[0])
+			if key == tags.Packages {
+				found = tags.HasPackage(instance.Tags[key], kv[1])
+			} else {
+				found = strings.Contains(instance.Tags[key], kv[1])
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+
 		found = false
-		for _, tag := range instance.Tags {
-			if strings.Contains(*tag.Value, value) {
+		for _, tagValue := range instance.Tags {
+			if strings.Contains(tagValue, value) {
 				found = true
 				break
 			}
 		}
-		if !strings.Contains(*instance.InstanceId, value) && !strings.Contains(*instance.PrivateDnsName, value) && !strings.Contains(*instance.PublicDnsName, value) && found == false {
+		if !strings.Contains(instance.Id, value) && !strings.Contains(instance.PrivateDns, value) && !strings.Contains(instance.PublicDns, value) &&
+			!strings.Contains(instance.PrivateIp, value) && !strings.Contains(instance.PublicIp, value) && found == false {
 			return false
 		}
 	}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
 	"strings"
@@ -18,13 +19,37 @@ import (
 const cmdDeploy = "deploy"
 const cmdInstall = "install"
 
+// resultCommands are the commands that run on each instance and give a result
+// for each.
+var resultCommands = map[string]bool{cmdDeploy: true, cmdInstall: true, "exec": true,
+	"run": true, "scp": true, "sync": true, "fetch": true}
+
 var argNum = 0
 
 var projectName = flag.String("project", "", "project name to use for AWS credentials")
+var allProjects = flag.Bool("all-projects", false, "don't filter instances by their Project tag")
 var filterPackageName = flag.Bool("p", false, "filter by package name; detect it by default")
 var execInSeries = flag.Bool("s", false, "run the exec commands in series (default is parallel)")
+var execParallel = flag.Int("parallel", 0, "run on at most this many instances at once (default is all)")
+var batchSize = flag.String("batch", "", "run on this many instances, or percentage of them, at a time")
+var batchPause = flag.Duration("batch-pause", 0, "time to wait between batches")
+var connectTimeout = flag.Duration("connect-timeout", 0, "time limit for connecting to each instance (default 30s)")
+var connectRetries = flag.Int("connect-retries", -1, "times to retry connecting to an instance after a network error (default 2)")
+var commandTimeout = flag.Duration("command-timeout", 0, "time limit for each command on each instance")
+var overallTimeout = flag.Duration("timeout", 0, "time limit for the whole exec or deploy")
 var packageName = flag.String("package", "", "package name to filter by")
 var packageVersion = flag.String("version", "", "version of packages to install")
+var hostsFile = flag.String("hosts-file", "", "read hosts from a YAML or JSON file instead of EC2")
+var addressMode = flag.String("address", "", "which address to connect to: public-dns, public-ip, private-dns or private-ip")
+var bastion = flag.String("bastion", "", "connect through this bastion: [USER@]HOST[:PORT], or criteria such as cluster=bastion")
+var hostKeys = flag.String("host-keys", "", "host key policy: strict, tofu or console")
+var identityFile = flag.String("i", "", "private key file to authenticate with")
+var outputFormat = flag.String("output", OutputText, "output format: text, grouped, raw or json")
+var noTty = flag.Bool("no-tty", false, "don't request a pty, keeping commands' stdout and stderr apart")
+var useTemplate = flag.Bool("template", false, "expand exec commands and scp destinations as templates for each instance")
+var onlyFailed = flag.Bool("only-failed", false, "only use the instances that didn't succeed in the last run")
+var outputDir = flag.String("outdir", "", "also write each instance's output and result to files in this directory")
+var hostsCommand = flag.String("hosts-command", "", "read hosts from the JSON output of a command instead of EC2")
 var args []string
 
 type dotfileNotFoundError struct {
@@ -53,6 +78,31 @@ func main() {
 
 	cmd := getNextArg("command not given")
 
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var lastRun *runState
+	if cmd == cmdRetry || *onlyFailed {
+		lastRun, err = loadRunState(stateFilePath(config))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if lastRun.Env != env || lastRun.Cluster != cluster {
+			log.Fatalf("the last run was on %s/%s, not %s/%s\n", lastRun.Env,
+				lastRun.Cluster, env, cluster)
+		}
+	}
+	retrying := cmd == cmdRetry
+	if retrying {
+		cmd = lastRun.Command
+		args, argNum = lastRun.Args, 0
+		lastRun.restoreFlags()
+	}
+	thisRun := &runState{Env: env, Cluster: cluster, Command: cmd,
+		Args: args[argNum:], Version: *packageVersion, AllProjects: *allProjects}
+
 	if *projectName == "" {
 		*projectName = os.Getenv("AWS_DEFAULT_PROFILE")
 		if *projectName == "" {
@@ -67,61 +117,128 @@ func main() {
 	}
 
 	var packageNames, filterPackageNames []string
+	if retrying {
+		// The packages are those of the last run, rather than detected again.
+		packageNames, filterPackageNames = lastRun.PackageNames, lastRun.FilterPackageNames
+	} else {
+		packageNames, filterPackageNames = getPackageNames(cmd)
+	}
+	thisRun.Project = *projectName
+	thisRun.PackageNames, thisRun.FilterPackageNames = packageNames, filterPackageNames
 
-	if cmd == cmdDeploy || cmd == cmdInstall {
-		packageNames = getRemainingArgsAsSlice("")
-		if cmd == cmdInstall && len(packageNames) == 0 {
-			log.Fatalln("no packages given")
+	if *addressMode != "" {
+		if !isAddressMode(*addressMode) {
+			fatalUsageError("unknown address: " + *addressMode)
 		}
+		config.Ssh.Address = *addressMode
+	}
+	if *bastion != "" {
+		config.Ssh.Bastion = *bastion
+	}
+	if *connectTimeout != 0 {
+		config.Ssh.ConnectTimeout = *connectTimeout
+	}
+	if *connectRetries >= 0 {
+		config.Ssh.ConnectRetries = *connectRetries
+	}
+	if *identityFile != "" {
+		config.Ssh.IdentityFile = *identityFile
+	}
+	if *hostKeys != "" {
+		if !isHostKeysMode(*hostKeys) {
+			fatalUsageError("unknown host key policy: " + *hostKeys)
+		}
+		config.Ssh.HostKeys = *hostKeys
 	}
 
-	if cmd == cmdDeploy {
-		*filterPackageName = true
-		filterPackageNames = packageNames
+	inventory, err := getInventory(*projectName, config)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	if *filterPackageName && (filterPackageNames == nil || len(filterPackageNames) == 0) {
-		if *packageName == "" {
-			filterPackageNames, err = detectPackageNames()
-			if err != nil {
-				log.Fatalln(err)
-			}
-		} else {
-			filterPackageNames = []string{*packageName}
-		}
+	filterProject := *projectName
+	if *allProjects {
+		filterProject = ""
 	}
 
-	if cmd == cmdDeploy {
-		packageNames = filterPackageNames
+	if !isOutputFormat(*outputFormat) {
+		fatalUsageError("unknown output format: " + *outputFormat)
 	}
 
-	awsConf, err := getAWSConf(*projectName)
+	job, err := NewJob(inventory, config, env, cluster, filterProject, packageNames,
+		filterPackageNames, os.Stdout, os.Stderr, *outputFormat, term.IsTerminal(syscall.Stdout))
 	if err != nil {
 		log.Fatalln(err)
 	}
-	job, err := NewJob(awsConf, env, cluster, *projectName, packageNames,
-		filterPackageNames, os.Stdout, term.IsTerminal(syscall.Stdout))
-	if err != nil {
-		log.Fatalln(err)
+
+	if lastRun != nil {
+		if err := job.OnlyInstances(lastRun.FailedIds()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *outputDir != "" && resultCommands[cmd] {
+		if err := job.WriteOutputTo(*outputDir); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	execOpts := ExecOptions{Parallel: *execParallel, BatchSize: *batchSize,
+		BatchPause: *batchPause, CommandTimeout: *commandTimeout,
+		Timeout: *overallTimeout, NoTty: *noTty, Template: *useTemplate}
+	if *execInSeries {
+		execOpts.Parallel = 1
+	}
+	if _, err := parseBatchSize(execOpts.BatchSize, 1); err != nil {
+		fatalUsageError(err.Error())
 	}
+	thisRun.Options = execOpts
 
 	switch cmd {
-	case cmdDeploy:
-		showErrorsList(job.Deploy(true, *execInSeries, *packageVersion))
-	case cmdInstall:
-		showErrorsList(job.Deploy(false, *execInSeries, *packageVersion))
+	case cmdDeploy, cmdInstall:
+		handleInterrupts(job)
+		results, err := job.Deploy(cmd == cmdDeploy, *packageVersion, execOpts)
+		exitWithResults(job, thisRun, results, err)
 	case "exec":
 		cmd := getRemainingArgsAsString("command not given")
-		showErrorsList(job.Exec(cmd, *execInSeries))
+		handleInterrupts(job)
+		results, err := job.Exec(cmd, execOpts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		exitWithResults(job, thisRun, results, nil)
+	case "run":
+		handleInterrupts(job)
+		results, err := job.Run(getRemainingArgsAsSlice("script not given"), execOpts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		exitWithResults(job, thisRun, results, nil)
 	case "ssh":
 		hostName := getNextArg("")
 		sshArgs := getRemainingArgsAsSlice("")
 		err = job.Ssh(hostName, sshArgs)
 	case "scp":
-		if len(args) <= argNum {
-			log.Fatalln("you must give at least one source file")
+		handleInterrupts(job)
+		results, err := job.Scp(args[argNum:], execOpts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		exitWithResults(job, thisRun, results, nil)
+	case "sync":
+		handleInterrupts(job)
+		results, err := job.Sync(args[argNum:], execOpts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		exitWithResults(job, thisRun, results, nil)
+	case "fetch":
+		handleInterrupts(job)
+		results, err := job.Fetch(args[argNum:], execOpts)
+		if err != nil {
+			log.Fatalln(err)
 		}
-		err = job.Scp(args[argNum:])
+		exitWithResults(job, thisRun, results, nil)
 	case "ls":
 		err = job.List()
 	case "hostname":
@@ -136,14 +253,111 @@ func main() {
 	}
 }
 
-func showErrorsList(errs []error) {
-	if len(errs) > 0 {
-		errStrings := make([]string, len(errs))
-		for i, err := range errs {
-			errStrings[i] = err.Error()
+// getPackageNames gives the packages to install and to filter instances by,
+// from the command line or detected from the current directory.
+func getPackageNames(cmd string) (packageNames []string, filterPackageNames []string) {
+	var err error
+
+	if cmd == cmdDeploy || cmd == cmdInstall {
+		packageNames = getRemainingArgsAsSlice("")
+		if cmd == cmdInstall && len(packageNames) == 0 {
+			log.Fatalln("no packages given")
 		}
-		log.Fatalf(strings.Join(errStrings, "\n"))
 	}
+
+	if cmd == cmdDeploy {
+		*filterPackageName = true
+		filterPackageNames = packageNames
+	}
+
+	if *filterPackageName && (filterPackageNames == nil || len(filterPackageNames) == 0) {
+		if *packageName == "" {
+			filterPackageNames, err = detectPackageNames()
+			if err != nil {
+				log.Fatalln(err)
+			}
+		} else {
+			filterPackageNames = []string{*packageName}
+		}
+	}
+
+	if cmd == cmdDeploy {
+		packageNames = filterPackageNames
+	}
+	return
+}
+
+func getInventory(projectName string, config *Config) (Inventory, error) {
+	if *hostsFile != "" {
+		return &FileInventory{Path: *hostsFile, Tags: config.Tags}, nil
+	}
+	if *hostsCommand != "" {
+		return &CommandInventory{Command: *hostsCommand, Tags: config.Tags}, nil
+	}
+
+	if len(config.Targets) == 0 {
+		awsConf, err := getAWSConf(projectName, "")
+		if err != nil {
+			return nil, err
+		}
+		return NewEC2Inventory(awsConf, config.Tags), nil
+	}
+
+	profiles := make([]string, len(config.Targets))
+	for i, target := range config.Targets {
+		profiles[i] = target.Profile
+		if profiles[i] == "" {
+			profiles[i] = projectName
+		}
+		if usesEnvCredentials() && profiles[i] != profiles[0] {
+			return nil, fmt.Errorf("targets %s and %s use different profiles, but the AWS_ACCESS_KEY_ID in the environment would be used for both; unset it to use the profiles",
+				config.Targets[0].Name, target.Name)
+		}
+	}
+
+	// Sessions are made one at a time, as each may prompt for an MFA code.
+	inventories := make(MultiInventory, len(config.Targets))
+	for i, target := range config.Targets {
+		awsConf, err := getAWSConf(profiles[i], target.Region)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %s", target.Name, err)
+		}
+		inventories[i] = NewEC2Inventory(awsConf, config.Tags)
+	}
+	return inventories, nil
+}
+
+// handleInterrupts stops the job's commands on the first SIGINT or SIGTERM,
+// so the results can still be printed, and quits at once on the second.
+func handleInterrupts(job *Job) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Interrupting commands; press Ctrl-C again to quit now")
+		job.Interrupt()
+		<-signals
+		os.Exit(ExitInterrupted)
+	}()
+}
+
+// exitWithResults prints the summary of an exec or deploy, records it in the
+// state file, and exits with a status giving whether some or all of the
+// instances failed. err is an error from after the commands were run, such as
+// from a deploy hook.
+func exitWithResults(job *Job, state *runState, results []*ExecResult, err error) {
+	job.PrintResults(results)
+	if saveErr := state.save(stateFilePath(job.config), results); saveErr != nil {
+		log.Println("[WARNING] couldn't save the results:", saveErr)
+	}
+	code := resultsExitCode(results)
+	if err != nil {
+		log.Println(err)
+		if code == ExitOk {
+			code = 1
+		}
+	}
+	os.Exit(code)
 }
 
 func fatalUsageError(errMsg string) {
@@ -202,6 +416,31 @@ func findDotfileAndRead(fn string, errName string) (value string, err error) {
 	return "", dotfileNotFoundError{name: errName}
 }
 
+// findDotfile is like findDotfileAndRead, but gives the path of the file
+// found rather than its contents.
+func findDotfile(fn string) (fPath string, err error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return
+	}
+
+	var newDir string
+	for {
+		fPath = path.Join(dir, fn)
+		if _, err := os.Stat(fPath); err == nil {
+			return fPath, nil
+		}
+
+		newDir = path.Dir(dir)
+		if dir == newDir {
+			break
+		}
+		dir = newDir
+	}
+
+	return "", dotfileNotFoundError{name: fn}
+}
+
 func findDotfilesAndRead(fns []string, errName string) (value string, err error) {
 	for _, fn := range fns {
 		value, err = findDotfileAndRead(fn, errName)
@@ -217,8 +456,25 @@ func findDotfilesAndRead(fns []string, errName string) (value string, err error)
 	return
 }
 
+// projectDotfiles are the files the project name is read from, in the
+// project's directory.
+var projectDotfiles = []string{".project-name", ".moltar-project", ".mxm-project"}
+
 func detectProjectName() (projectName string, err error) {
-	return findDotfilesAndRead([]string{".project-name", ".moltar-project", ".mxm-project"}, "Project name")
+	return findDotfilesAndRead(projectDotfiles, "Project name")
+}
+
+// findProjectDir gives the directory a project dotfile is found in.
+func findProjectDir() (dir string, err error) {
+	for _, fn := range projectDotfiles {
+		fPath, err := findDotfile(fn)
+		if err == nil {
+			return path.Dir(fPath), nil
+		} else if _, ok := err.(dotfileNotFoundError); !ok {
+			return "", err
+		}
+	}
+	return "", dotfileNotFoundError{name: "Project name"}
 }
 
 var packageNamePattern = regexp.MustCompile(`\b[-\w]+\b`)
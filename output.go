@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	OutputText    = "text"
+	OutputJson    = "json"
+	OutputGrouped = "grouped"
+	OutputRaw     = "raw"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// execOutput is where the output of exec and deploy goes.
+type execOutput interface {
+	// Message reports progress, such as the command about to be run.
+	Message(msg string)
+	// Output is called with the bytes a command writes on an instance, as
+	// they're read, and with nil data when the stream ends.
+	Output(host *Host, stream string, data []byte)
+	// Results is called with the result on every instance at the end.
+	Results(results []*ExecResult)
+}
+
+func isOutputFormat(format string) bool {
+	switch format {
+	case OutputText, OutputJson, OutputGrouped, OutputRaw:
+		return true
+	}
+	return false
+}
+
+func newExecOutput(job *Job, format string) execOutput {
+	switch format {
+	case OutputJson:
+		return newJsonOutput(job.output)
+	case OutputGrouped:
+		return &groupedOutput{textOutput: textOutput{job: job}, data: map[*Host][]byte{}}
+	case OutputRaw:
+		return &rawOutput{job: job}
+	}
+	return &textOutput{job: job, lines: newLineSplitter()}
+}
+
+// lineSplitter splits each instance's streams into lines, holding on to the
+// last part of a line until the rest of it arrives. A line keeps everything
+// but its \n, or \r\n as a pty gives.
+type lineSplitter struct {
+	partial map[lineSplitterKey][]byte
+	lock    sync.Mutex
+}
+
+type lineSplitterKey struct {
+	host   *Host
+	stream string
+}
+
+func newLineSplitter() *lineSplitter {
+	return &lineSplitter{partial: map[lineSplitterKey][]byte{}}
+}
+
+// split gives the lines completed by data. If data is nil, the stream has
+// ended, so whatever is left is given as the last line.
+func (self *lineSplitter) split(host *Host, stream string, data []byte) (lines []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := lineSplitterKey{host, stream}
+	buf := append(self.partial[key], data...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i == -1 {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(string(buf[:i]), "\r"))
+		buf = buf[i+1:]
+	}
+
+	if data == nil {
+		if len(buf) > 0 {
+			lines = append(lines, string(buf))
+		}
+		delete(self.partial, key)
+	} else {
+		self.partial[key] = append([]byte(nil), buf...)
+	}
+	return
+}
+
+/// Text
+
+// textOutput prefixes each line with the instance it came from, and finishes
+// with a table of results. Stderr goes to moltar's stderr.
+type textOutput struct {
+	job   *Job
+	lines *lineSplitter
+}
+
+func (self *textOutput) Message(msg string) {
+	fmt.Fprintln(self.job.output, msg)
+}
+
+func (self *textOutput) Output(host *Host, stream string, data []byte) {
+	logger := self.job.instanceLogger(host)
+	if stream == StreamStderr {
+		logger = self.job.instanceErrLogger(host)
+	}
+	for _, line := range self.lines.split(host, stream, data) {
+		// Repeat the prefix after each \r, so a line that's overwritten, such
+		// as a progress bar, keeps it.
+		logger.Println(strings.Replace(line, "\r", "\r"+logger.Prefix(), -1))
+	}
+}
+
+func (self *textOutput) Results(results []*ExecResult) {
+	fmt.Fprint(self.job.output, "\n"+formatResults(results))
+}
+
+/// Grouped
+
+// groupedOutput holds on to each instance's output until the end, then prints
+// it once for each group of instances with the same output and result, as
+// dshbak -c does. The most common group comes first, and the others are
+// highlighted as differing from it.
+type groupedOutput struct {
+	textOutput
+	data map[*Host][]byte
+	lock sync.Mutex
+}
+
+type outputGroup struct {
+	hosts  []string
+	result *ExecResult
+	data   []byte
+}
+
+func (self *groupedOutput) Output(host *Host, stream string, data []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.data[host] = append(self.data[host], data...)
+}
+
+func (self *groupedOutput) Results(results []*ExecResult) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	groups := []*outputGroup{}
+	byKey := map[string]*outputGroup{}
+	for _, result := range results {
+		data := self.data[result.Host]
+		key := fmt.Sprintf("%s\x00%d\x00%s\x00%s", result.Status(), result.ExitStatus,
+			result.Signal, data)
+		group := byKey[key]
+		if group == nil {
+			group = &outputGroup{result: result, data: data}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.hosts = append(group.hosts, instanceLogName(result.Host))
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].hosts) > len(groups[j].hosts)
+	})
+
+	w := self.job.output
+	for n, group := range groups {
+		sort.Strings(group.hosts)
+		header := fmt.Sprintf("%s (%d)", strings.Join(group.hosts, ", "), len(group.hosts))
+		if !group.result.OK() {
+			header += " " + group.result.Status()
+			if group.result.ExitStatus > 0 {
+				header += fmt.Sprintf(", exit %d", group.result.ExitStatus)
+			}
+		}
+		if n > 0 {
+			header += " [differs]"
+		}
+		rule := strings.Repeat("-", len(header))
+		if n > 0 && self.job.shouldOutputAnsiEscapes {
+			header = "\033[1;31m" + header + "\033[0m"
+		} else if self.job.shouldOutputAnsiEscapes {
+			header = "\033[1m" + header + "\033[0m"
+		}
+
+		fmt.Fprintf(w, "\n%s\n%s\n%s\n", rule, header, rule)
+		w.Write(group.data)
+		if len(group.data) > 0 && group.data[len(group.data)-1] != '\n' {
+			fmt.Fprintln(w)
+		}
+	}
+
+	self.textOutput.Results(results)
+}
+
+/// Raw
+
+// rawOutput passes on the output of commands exactly as it is, with stdout to
+// moltar's stdout and stderr to its stderr. Everything else goes to stderr.
+// It's meant for running on a single instance, as output from many is mixed
+// together.
+type rawOutput struct {
+	job  *Job
+	lock sync.Mutex
+}
+
+func (self *rawOutput) Message(msg string) {
+	fmt.Fprintln(self.job.errOutput, msg)
+}
+
+func (self *rawOutput) Output(host *Host, stream string, data []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if stream == StreamStderr {
+		self.job.errOutput.Write(data)
+	} else {
+		self.job.output.Write(data)
+	}
+}
+
+func (self *rawOutput) Results(results []*ExecResult) {
+	fmt.Fprint(self.job.errOutput, "\n"+formatResults(results))
+}
+
+/// Files
+
+// fileOutput writes each instance's stdout and stderr exactly to DIR/NAME.out
+// and DIR/NAME.err, and its result to DIR/NAME.json, as well as passing
+// everything on to another execOutput.
+type fileOutput struct {
+	execOutput
+	dir   string
+	names map[*Host]string
+	files map[*Host]*hostOutputFiles
+	lock  sync.Mutex
+}
+
+type hostOutputFiles struct {
+	out *os.File
+	err *os.File
+}
+
+func newFileOutput(next execOutput, dir string, instances []*Host) (*fileOutput, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileOutput{execOutput: next, dir: dir, names: outputFileNames(instances),
+		files: map[*Host]*hostOutputFiles{}}, nil
+}
+
+// outputFileNames gives each instance a file name, using its instance ID as
+// well where its name isn't unique.
+func outputFileNames(instances []*Host) map[*Host]string {
+	counts := map[string]int{}
+	for _, i := range instances {
+		counts[instanceLogName(i)] += 1
+	}
+
+	names := map[*Host]string{}
+	for _, i := range instances {
+		name := instanceLogName(i)
+		if name == "" {
+			name = i.Id
+		} else if counts[name] > 1 && i.Id != "" {
+			name += "-" + i.Id
+		}
+		name = strings.Replace(name, string(os.PathSeparator), "_", -1)
+		names[i] = strings.TrimLeft(name, ".")
+	}
+	return names
+}
+
+// hostFiles opens the instance's files the first time they're needed. The
+// caller must hold the lock.
+func (self *fileOutput) hostFiles(host *Host) (files *hostOutputFiles, err error) {
+	if files = self.files[host]; files != nil {
+		return
+	}
+
+	base := filepath.Join(self.dir, self.names[host])
+	files = &hostOutputFiles{}
+	if files.out, err = os.Create(base + ".out"); err != nil {
+		return nil, err
+	}
+	if files.err, err = os.Create(base + ".err"); err != nil {
+		files.out.Close()
+		return nil, err
+	}
+	self.files[host] = files
+	return
+}
+
+func (self *fileOutput) Output(host *Host, stream string, data []byte) {
+	self.execOutput.Output(host, stream, data)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	files, err := self.hostFiles(host)
+	if err != nil {
+		log.Println("[WARNING] couldn't write output:", err)
+		return
+	}
+	f := files.out
+	if stream == StreamStderr {
+		f = files.err
+	}
+	f.Write(data)
+}
+
+func (self *fileOutput) Results(results []*ExecResult) {
+	self.lock.Lock()
+	for _, result := range results {
+		if err := self.writeResult(result); err != nil {
+			log.Println("[WARNING] couldn't write result:", err)
+		}
+	}
+	self.lock.Unlock()
+
+	self.execOutput.Results(results)
+}
+
+// writeResult closes the instance's output files, creating them if there was
+// no output, so that every instance has them.
+func (self *fileOutput) writeResult(result *ExecResult) error {
+	files, err := self.hostFiles(result.Host)
+	if err != nil {
+		return err
+	}
+	files.out.Close()
+	files.err.Close()
+
+	b, err := json.MarshalIndent(&jsonEvent{Type: "result", Host: instanceLogName(result.Host),
+		Id: result.Host.Id, jsonResult: newJsonResult(result)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(self.dir, self.names[result.Host]+".json"),
+		append(b, '\n'), 0644)
+}
+
+/// JSON
+
+// jsonOutput writes a JSON object per line for each message, line of output
+// and result.
+type jsonOutput struct {
+	enc   *json.Encoder
+	lines *lineSplitter
+	lock  sync.Mutex
+}
+
+type jsonEvent struct {
+	Type    string  `json:"type"`
+	Message string  `json:"message,omitempty"`
+	Host    string  `json:"host,omitempty"`
+	Id      string  `json:"id,omitempty"`
+	Stream  string  `json:"stream,omitempty"`
+	Line    *string `json:"line,omitempty"`
+	*jsonResult
+}
+
+type jsonResult struct {
+	Status     string  `json:"status"`
+	ExitStatus *int    `json:"exit_status"`
+	Signal     string  `json:"signal,omitempty"`
+	Duration   float64 `json:"duration"`
+	BytesOut   int64   `json:"bytes_out"`
+	BytesErr   int64   `json:"bytes_err"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func newJsonOutput(w io.Writer) *jsonOutput {
+	return &jsonOutput{enc: json.NewEncoder(w), lines: newLineSplitter()}
+}
+
+func (self *jsonOutput) write(event *jsonEvent) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.enc.Encode(event)
+}
+
+func (self *jsonOutput) Message(msg string) {
+	self.write(&jsonEvent{Type: "message", Message: strings.TrimSpace(msg)})
+}
+
+func (self *jsonOutput) Output(host *Host, stream string, data []byte) {
+	for _, line := range self.lines.split(host, stream, data) {
+		line := line
+		self.write(&jsonEvent{Type: "output", Host: instanceLogName(host), Id: host.Id,
+			Stream: stream, Line: &line})
+	}
+}
+
+func (self *jsonOutput) Results(results []*ExecResult) {
+	for _, result := range results {
+		self.write(&jsonEvent{Type: "result", Host: instanceLogName(result.Host),
+			Id: result.Host.Id, jsonResult: newJsonResult(result)})
+	}
+}
+
+func newJsonResult(result *ExecResult) *jsonResult {
+	r := &jsonResult{Status: result.Status(), Signal: result.Signal,
+		Duration: result.Duration.Seconds(), BytesOut: result.BytesOut,
+		BytesErr: result.BytesErr}
+	if result.ExitStatus >= 0 {
+		exitStatus := result.ExitStatus
+		r.ExitStatus = &exitStatus
+	}
+	if result.Err != nil {
+		r.Error = result.Err.Error()
+	}
+	return r
+}
+
+// jsonHost is how ls and hostname describe an instance.
+type jsonHost struct {
+	*Host
+	Address string `json:"address"`
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit codes for exec and deploy. 1 is left for moltar's own errors.
+const (
+	ExitOk         = 0
+	ExitSomeFailed = 2
+	ExitAllFailed  = 3
+	// ExitInterrupted is used when moltar is interrupted twice, and quits
+	// without waiting for the results.
+	ExitInterrupted = 130
+)
+
+const (
+	ResultOk          = "ok"
+	ResultFailed      = "failed"
+	ResultUnreachable = "unreachable"
+	ResultNotRun      = "not run"
+	ResultInterrupted = "interrupted"
+	ResultIncomplete  = "incomplete"
+)
+
+var ErrLaterCommandsNotRun = errors.New("later commands not run, as this one failed on other instances")
+
+// ExecResult is the outcome of running a command, or a deploy's commands, on
+// one instance.
+type ExecResult struct {
+	Host *Host
+	// ExitStatus is -1 if the command didn't exit normally, or wasn't run.
+	ExitStatus int
+	Signal     string
+	Duration   time.Duration
+	BytesOut   int64
+	BytesErr   int64
+	Err        error
+	// Unreachable is set if the instance couldn't be connected to.
+	Unreachable bool
+	// NotRun is set if the instance was skipped, as an earlier batch failed
+	// or the job timed out or was interrupted.
+	NotRun bool
+	// Interrupted is set if the command was stopped part way through, as the
+	// job was interrupted.
+	Interrupted bool
+	// Incomplete is set if a deploy's commands succeeded on the instance as
+	// far as they went, but later ones weren't run as one failed elsewhere.
+	Incomplete bool
+}
+
+func newExecResult(host *Host) *ExecResult {
+	return &ExecResult{Host: host, ExitStatus: -1}
+}
+
+// setErr records the error returned by a command, including its exit status.
+func (self *ExecResult) setErr(err error) {
+	self.Err = err
+	switch e := err.(type) {
+	case nil:
+		self.ExitStatus = 0
+	case *ssh.ExitError:
+		self.ExitStatus = e.ExitStatus()
+		self.Signal = e.Signal()
+	}
+}
+
+// add accumulates the result of a later command on the same instance.
+func (self *ExecResult) add(next *ExecResult) {
+	self.ExitStatus = next.ExitStatus
+	self.Signal = next.Signal
+	self.Duration += next.Duration
+	self.BytesOut += next.BytesOut
+	self.BytesErr += next.BytesErr
+	self.Err = next.Err
+	self.Unreachable = next.Unreachable
+	self.NotRun = next.NotRun
+	self.Interrupted = next.Interrupted
+}
+
+func (self *ExecResult) OK() bool {
+	return self.Err == nil
+}
+
+func (self *ExecResult) Status() string {
+	switch {
+	case self.Err == nil:
+		return ResultOk
+	case self.Unreachable:
+		return ResultUnreachable
+	case self.NotRun:
+		return ResultNotRun
+	case self.Interrupted:
+		return ResultInterrupted
+	case self.Incomplete:
+		return ResultIncomplete
+	}
+	return ResultFailed
+}
+
+func (self *ExecResult) Error() string {
+	return fmt.Sprintf("%s : %s", instanceLogName(self.Host), self.Err)
+}
+
+// failedResults gives the results where the command failed, or couldn't be
+// run as the instance was unreachable. Instances that weren't run or were
+// left incomplete because of failures elsewhere aren't included.
+func failedResults(results []*ExecResult) (failed []*ExecResult) {
+	for _, result := range results {
+		if !result.OK() && !result.NotRun && !result.Incomplete {
+			failed = append(failed, result)
+		}
+	}
+	return
+}
+
+// resultsExitCode gives ExitAllFailed only if the command failed on every
+// instance, and ExitSomeFailed if any others didn't succeed.
+func resultsExitCode(results []*ExecResult) int {
+	unsuccessful := 0
+	for _, result := range results {
+		if !result.OK() {
+			unsuccessful += 1
+		}
+	}
+	switch {
+	case unsuccessful == 0:
+		return ExitOk
+	case len(failedResults(results)) == len(results):
+		return ExitAllFailed
+	}
+	return ExitSomeFailed
+}
+
+var resultStatusOrder = map[string]int{
+	ResultOk: 0, ResultFailed: 1, ResultInterrupted: 2, ResultUnreachable: 3, ResultIncomplete: 4,
+	ResultNotRun: 5,
+}
+
+// formatResults gives a table of results, ordered by status and then
+// instance name, followed by a count of each status.
+func formatResults(results []*ExecResult) string {
+	sorted := make([]*ExecResult, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		si, sj := resultStatusOrder[sorted[i].Status()], resultStatusOrder[sorted[j].Status()]
+		if si != sj {
+			return si < sj
+		}
+		return instanceLogName(sorted[i].Host) < instanceLogName(sorted[j].Host)
+	})
+
+	counts := map[string]int{}
+	fields := make([][]string, 0, len(results)+1)
+	fields = append(fields, []string{"HOST", "STATUS", "EXIT", "TIME", "OUT", "ERR", "ERROR"})
+	for _, result := range sorted {
+		counts[result.Status()] += 1
+
+		exit := ""
+		if result.Signal != "" {
+			exit = "SIG" + result.Signal
+		} else if result.ExitStatus >= 0 {
+			exit = strconv.Itoa(result.ExitStatus)
+		}
+		errString := ""
+		if result.Err != nil {
+			errString = result.Err.Error()
+		}
+
+		fields = append(fields, []string{instanceLogName(result.Host), result.Status(),
+			exit, result.Duration.Round(100 * time.Millisecond).String(),
+			strconv.FormatInt(result.BytesOut, 10), strconv.FormatInt(result.BytesErr, 10),
+			errString})
+	}
+
+	summary := fmt.Sprintf("%d succeeded, %d failed, %d unreachable, %d not run",
+		counts[ResultOk], counts[ResultFailed], counts[ResultUnreachable], counts[ResultNotRun])
+	if counts[ResultInterrupted] > 0 {
+		summary += fmt.Sprintf(", %d interrupted", counts[ResultInterrupted])
+	}
+	if counts[ResultIncomplete] > 0 {
+		summary += fmt.Sprintf(", %d incomplete", counts[ResultIncomplete])
+	}
+	return formatTable(fields) + "\n" + summary + "\n"
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// scriptRun is a local script to run on each instance.
+type scriptRun struct {
+	script      []byte
+	args        []string
+	interpreter string
+	sudo        bool
+	env         []string
+	// tmpDir is the remote directory the script is saved in, as a shell
+	// word. It defaults to $TMPDIR, or /tmp.
+	tmpDir string
+}
+
+// parseRunArgs reads the arguments to the run command: options, the local
+// script, and the arguments to give it.
+func parseRunArgs(args []string) (run *scriptRun, err error) {
+	run = &scriptRun{tmpDir: `"${TMPDIR:-/tmp}"`}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		switch {
+		case arg == "-sudo":
+			run.sudo = true
+		case strings.HasPrefix(arg, "-interpreter="):
+			run.interpreter = strings.TrimPrefix(arg, "-interpreter=")
+		case strings.HasPrefix(arg, "-tmpdir="):
+			run.tmpDir = shellQuote(strings.TrimPrefix(arg, "-tmpdir="))
+		case arg == "-e":
+			if len(args) == 0 {
+				return nil, errors.New("-e must be followed by NAME=VALUE")
+			}
+			if err = run.addEnv(args[0]); err != nil {
+				return
+			}
+			args = args[1:]
+		default:
+			return nil, fmt.Errorf("unknown run option %s", arg)
+		}
+	}
+	if len(args) == 0 {
+		return nil, errors.New("script not given")
+	}
+
+	if run.script, err = ioutil.ReadFile(args[0]); err != nil {
+		return
+	}
+	run.args = args[1:]
+	return
+}
+
+func (self *scriptRun) addEnv(assignment string) error {
+	parts := strings.SplitN(assignment, "=", 2)
+	if len(parts) != 2 || !envNameRegexp.MatchString(parts[0]) {
+		return fmt.Errorf("bad environment variable %s; it should be NAME=VALUE", assignment)
+	}
+	self.env = append(self.env, parts[0]+"="+shellQuote(parts[1]))
+	return nil
+}
+
+// command gives the remote command that saves the script, from its stdin, to
+// a temporary file, runs it, and then deletes it, exiting with the script's
+// status. The file is deleted by a trap, so it's also deleted if the shell is
+// sent SIGTERM as the command times out or moltar is interrupted, which only
+// happens if the server supports signals. The script runs in the background
+// so the shell can handle the signal straight away, passing it on. SIGINT
+// isn't trapped, as background jobs ignore it.
+func (self *scriptRun) command() string {
+	invoke := []string{}
+	if self.sudo {
+		invoke = append(invoke, "sudo")
+	}
+	if len(self.env) > 0 {
+		invoke = append(invoke, "env")
+		invoke = append(invoke, self.env...)
+	}
+	if self.interpreter != "" {
+		invoke = append(invoke, self.interpreter)
+	}
+	invoke = append(invoke, `"$f"`)
+	for _, arg := range self.args {
+		invoke = append(invoke, shellQuote(arg))
+	}
+
+	return strings.Join([]string{
+		`f=$(mktemp ` + self.tmpDir + `/moltar-run.XXXXXXXXXX) || exit 1`,
+		`trap 'rm -f "$f"' EXIT`,
+		`trap 'kill -HUP $p 2>/dev/null; exit 129' HUP`,
+		`trap 'kill -TERM $p 2>/dev/null; exit 143' TERM`,
+		`cat > "$f" && chmod 700 "$f" || exit 1`,
+		strings.Join(invoke, " ") + ` & p=$!`,
+		`wait $p`,
+	}, "; ")
+}
+
+// Run copies a local script to each instance over its session, runs it, and
+// gives the result on each, as Exec does.
+func (self *Job) Run(args []string, opts ExecOptions) (results []*ExecResult, err error) {
+	run, err := parseRunArgs(args)
+	if err != nil {
+		return
+	}
+
+	// The script is sent on stdin, which a pty would mangle.
+	opts.NoTty = true
+	cmd := run.command()
+	stdin := &bytesStdin{run.script}
+	results, err = self.execBatches(opts, func(batch []*Host) []*ExecResult {
+		return self.execOn(batch, fixedCommand(cmd), opts, stdin)
+	})
+	return
+}
+
+// bytesStdin gives every instance the same bytes as stdin.
+type bytesStdin struct {
+	b []byte
+}
+
+func (self *bytesStdin) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(self.b)), nil
+}
+
+func (self *bytesStdin) Skip() {}
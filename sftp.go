@@ -0,0 +1,574 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpProgressInterval is how often progress is reported while copying.
+var sftpProgressInterval = 5 * time.Second
+
+// maxSymlinks is how many symlinks are followed in a row, as on Linux.
+const maxSymlinks = 40
+
+/// Uploads
+
+// sftpUpload is local files and directories to copy to the same place on
+// each instance.
+type sftpUpload struct {
+	sources []string
+	// roots are the sources with symlinks resolved, as scp follows those
+	// given on the command line. They're what's copied, under the sources'
+	// names.
+	roots     []string
+	dest      string
+	recursive bool
+	size      int64
+	// destTemplate is dest as a template for each instance, if templates
+	// are turned on.
+	destTemplate *template.Template
+}
+
+// parseScpArgs reads the arguments to the scp command: local files, an
+// optional :DEST, and -r to copy directories.
+func parseScpArgs(args []string, useTemplate bool) (upload *sftpUpload, err error) {
+	upload = &sftpUpload{}
+	destGiven := false
+	for _, arg := range args {
+		switch {
+		case arg == "":
+			return nil, errors.New("empty file name given")
+		case arg == "-r":
+			upload.recursive = true
+		case arg[0] == '-':
+			return nil, fmt.Errorf("unknown scp option %s", arg)
+		case arg[0] == ':':
+			if destGiven {
+				return nil, errors.New("only one remote destination may be given")
+			}
+			upload.dest, destGiven = arg[1:], true
+		default:
+			upload.sources = append(upload.sources, arg)
+		}
+	}
+	if len(upload.sources) == 0 {
+		return nil, errors.New("you must give at least one source file")
+	}
+	if useTemplate {
+		if upload.destTemplate, err = parseHostTemplate(upload.dest); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, src := range upload.sources {
+		root, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() && !upload.recursive {
+			return nil, fmt.Errorf("%s is a directory; give -r to copy it", src)
+		}
+		upload.roots = append(upload.roots, root)
+		err = filepath.Walk(root, func(fn string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				upload.size += info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Scp copies local files to each instance over SFTP, using the same
+// connections as exec, and gives the result on each.
+func (self *Job) Scp(args []string, opts ExecOptions) (results []*ExecResult, err error) {
+	upload, err := parseScpArgs(args, opts.Template)
+	if err != nil {
+		return
+	}
+
+	results, err = self.execBatches(opts, func(batch []*Host) []*ExecResult {
+		return self.runOn(batch, opts, func(instance *Host, index int) *ExecResult {
+			return self.upload(instance, index, upload, opts)
+		})
+	})
+	return
+}
+
+// upload copies upload to instance, whose index among those being copied to
+// is given for the destination's template.
+func (self *Job) upload(instance *Host, index int, upload *sftpUpload, opts ExecOptions) *ExecResult {
+	dest := upload.dest
+	if upload.destTemplate != nil {
+		var err error
+		if dest, err = expandHostTemplate(upload.destTemplate, instance, index); err != nil {
+			result := newExecResult(instance)
+			result.Err = err
+			return result
+		}
+	}
+
+	return self.sftpTransfer(instance, opts, upload.size, func(conn *ssh.Client, client *sftp.Client, progress *transferProgress) error {
+		return upload.run(client, dest, progress)
+	})
+}
+
+// sftpTransfer calls fn with the connection to instance and an SFTP client on
+// it, with the same time limits as a command. Progress is reported as the
+// instance's output.
+func (self *Job) sftpTransfer(instance *Host, opts ExecOptions, total int64, fn func(*ssh.Client, *sftp.Client, *transferProgress) error) (result *ExecResult) {
+	result = newExecResult(instance)
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	conn, ok := self.connect(instance, result)
+	if !ok {
+		return
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		result.setErr(err)
+		return
+	}
+	defer client.Close()
+
+	progress := newTransferProgress(total, func(line string) {
+		self.execOutput.Output(instance, StreamStdout, []byte(line+"\n"))
+	})
+	defer self.execOutput.Output(instance, StreamStdout, nil)
+
+	// As with a command, closing the client stops the transfer when it's over
+	// time or interrupted.
+	term := make(chan bool, 1)
+	returnChan := make(chan error, 1)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-term:
+			client.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		progress.start()
+		err := fn(conn, client, progress)
+		progress.stop()
+		returnChan <- err
+	}()
+
+	err = self.waitForCommand(term, returnChan, opts.CommandTimeout)
+	result.setErr(err)
+	result.Interrupted = err == ErrInterrupted
+	return
+}
+
+// run copies each source into dest if it's a directory, or to dest if there's
+// only one source.
+func (self *sftpUpload) run(client *sftp.Client, dest string, progress *transferProgress) error {
+	if dest == "" {
+		// Relative paths are from the user's home directory.
+		dest = "."
+	}
+
+	destIsDir := false
+	if info, err := client.Stat(dest); err == nil && info.IsDir() {
+		destIsDir = true
+	}
+	if len(self.sources) > 1 && !destIsDir {
+		return fmt.Errorf("%s isn't a directory", dest)
+	}
+
+	for i, src := range self.sources {
+		target := dest
+		if destIsDir {
+			target = path.Join(dest, filepath.Base(src))
+		}
+		if err := sftpCopy(client, self.roots[i], target, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpCopy copies the local file or directory src to target, keeping the
+// modes and modification times of files. src itself mustn't be a symlink.
+// Anything within it that isn't a regular file or a directory, such as a
+// symlink, is skipped.
+func sftpCopy(client *sftp.Client, src string, target string, progress *transferProgress) error {
+	var dirs []string
+	var dirModes []os.FileMode
+	err := filepath.Walk(src, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fn)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(target, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			if err := client.Mkdir(remote); err != nil {
+				if remoteInfo, statErr := client.Stat(remote); statErr != nil || !remoteInfo.IsDir() {
+					return err
+				}
+			}
+			// Directories are given their modes at the end, in case they
+			// aren't writable.
+			dirs = append(dirs, remote)
+			dirModes = append(dirModes, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return sftpCopyFile(client, fn, remote, info, progress)
+		default:
+			progress.output(fmt.Sprintf("skipping %s, as it isn't a regular file", fn))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := client.Chmod(dirs[i], dirModes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sftpCopyFile(client *sftp.Client, fn string, remote string, info os.FileInfo, progress *transferProgress) error {
+	local, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	f, err := client.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("%s: %s", remote, err)
+	}
+	_, err = io.Copy(f, &countingReader{r: local, count: &progress.bytes})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", remote, err)
+	}
+
+	if err = client.Chmod(remote, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = client.Chtimes(remote, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	progress.output(fmt.Sprintf("%s -> %s (%s)", fn, remote, formatBytes(info.Size())))
+	return nil
+}
+
+/// Downloads
+
+// sftpDownload is remote files, or glob patterns matching them, to copy from
+// each instance into a directory of its own.
+type sftpDownload struct {
+	patterns  []string
+	localDir  string
+	recursive bool
+	gzip      bool
+}
+
+// parseFetchArgs reads the arguments to the fetch command: remote files or
+// patterns, then the local directory, with -r to copy directories and -z to
+// gzip files.
+func parseFetchArgs(args []string) (download *sftpDownload, err error) {
+	download = &sftpDownload{}
+	var paths []string
+	for _, arg := range args {
+		switch {
+		case arg == "":
+			return nil, errors.New("empty file name given")
+		case arg == "-r":
+			download.recursive = true
+		case arg == "-z":
+			download.gzip = true
+		case arg[0] == '-':
+			return nil, fmt.Errorf("unknown fetch option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) < 2 {
+		return nil, errors.New("you must give at least one remote file and a local directory")
+	}
+	download.patterns = paths[:len(paths)-1]
+	download.localDir = paths[len(paths)-1]
+	return
+}
+
+// Fetch copies remote files from each instance over SFTP, into a directory
+// for each instance, and gives the result on each.
+func (self *Job) Fetch(args []string, opts ExecOptions) (results []*ExecResult, err error) {
+	download, err := parseFetchArgs(args)
+	if err != nil {
+		return
+	}
+
+	names := outputFileNames(self.instances)
+	results, err = self.execBatches(opts, func(batch []*Host) []*ExecResult {
+		return self.runOn(batch, opts, func(instance *Host, index int) *ExecResult {
+			dir := filepath.Join(download.localDir, names[instance])
+			return self.sftpTransfer(instance, opts, 0, func(conn *ssh.Client, client *sftp.Client, progress *transferProgress) error {
+				return download.run(client, dir, progress)
+			})
+		})
+	})
+	return
+}
+
+// run copies the files matching each pattern into dir, at the same path
+// under it as they have on the instance.
+func (self *sftpDownload) run(client *sftp.Client, dir string, progress *transferProgress) error {
+	for _, pattern := range self.patterns {
+		matches, err := client.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: no such file", pattern)
+		}
+
+		for _, match := range matches {
+			info, err := client.Stat(match)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				if err := self.fetchFile(client, match, match, dir, info, progress); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !self.recursive {
+				return fmt.Errorf("%s is a directory; give -r to copy it", match)
+			}
+			// The files are named as under match, even if it's a symlink.
+			root, err := resolveRemoteSymlinks(client, match)
+			if err != nil {
+				return err
+			}
+			fetched := 0
+			walker := client.Walk(root)
+			for walker.Step() {
+				if err := walker.Err(); err != nil {
+					return err
+				}
+				if walker.Stat().Mode().IsRegular() {
+					name := path.Join(match, strings.TrimPrefix(walker.Path(), root))
+					if err := self.fetchFile(client, walker.Path(), name, dir, walker.Stat(), progress); err != nil {
+						return err
+					}
+					fetched++
+				}
+			}
+			if fetched == 0 {
+				return fmt.Errorf("%s: no files to copy", match)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchFile copies the remote file into dir, at name under it, keeping its
+// mode and modification time.
+func (self *sftpDownload) fetchFile(client *sftp.Client, remote string, name string, dir string, info os.FileInfo, progress *transferProgress) (err error) {
+	// Cleaning it as an absolute path keeps it within dir.
+	local := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	if self.gzip {
+		local += ".gz"
+	}
+	if err = os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return
+	}
+
+	rf, err := client.Open(remote)
+	if err != nil {
+		return fmt.Errorf("%s: %s", remote, err)
+	}
+	defer rf.Close()
+
+	// An earlier copy is replaced rather than truncated, as it may be
+	// read-only. It's given the remote mode once written.
+	if err = os.Remove(local); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	lf, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	var w io.WriteCloser = lf
+	if self.gzip {
+		w = gzip.NewWriter(lf)
+	}
+	_, err = io.Copy(&countingWriter{w: w, count: &progress.bytes}, rf)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if self.gzip {
+		if closeErr := lf.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", remote, err)
+	}
+
+	if err = os.Chmod(local, info.Mode().Perm()); err != nil {
+		return
+	}
+	if err = os.Chtimes(local, info.ModTime(), info.ModTime()); err != nil {
+		return
+	}
+
+	progress.output(fmt.Sprintf("%s -> %s (%s)", remote, local, formatBytes(info.Size())))
+	return nil
+}
+
+// resolveRemoteSymlinks follows p on the remote host while it's a symlink,
+// giving the path it ends at. Walks Lstat their root, so don't go into a
+// symlinked directory unless given where it points.
+func resolveRemoteSymlinks(client *sftp.Client, p string) (string, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		info, err := client.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return p, nil
+		}
+		target, err := client.ReadLink(p)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(strings.TrimSuffix(p, "/")), target)
+		}
+		p = target
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+}
+
+/// Progress
+
+// transferProgress reports on one instance's transfer: a line for each file,
+// and how much has been copied every sftpProgressInterval.
+type transferProgress struct {
+	// bytes and total are updated as files are copied, so should be read
+	// with sync/atomic.
+	bytes  int64
+	total  int64
+	output func(line string)
+	done   chan bool
+}
+
+func newTransferProgress(total int64, output func(line string)) *transferProgress {
+	return &transferProgress{total: total, output: output, done: make(chan bool)}
+}
+
+func (self *transferProgress) start() {
+	go func() {
+		ticker := time.NewTicker(sftpProgressInterval)
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-ticker.C:
+				if bytes := atomic.LoadInt64(&self.bytes); bytes != last {
+					self.output(self.String())
+					last = bytes
+				}
+			case <-self.done:
+				return
+			}
+		}
+	}()
+}
+
+func (self *transferProgress) stop() {
+	close(self.done)
+}
+
+// setTotal gives the number of bytes to be copied, once it's known.
+func (self *transferProgress) setTotal(total int64) {
+	atomic.StoreInt64(&self.total, total)
+}
+
+func (self *transferProgress) String() string {
+	bytes, total := atomic.LoadInt64(&self.bytes), atomic.LoadInt64(&self.total)
+	if total == 0 {
+		return formatBytes(bytes) + " copied"
+	}
+	return fmt.Sprintf("%s of %s copied (%d%%)", formatBytes(bytes), formatBytes(total),
+		bytes*100/total)
+}
+
+// countingReader adds the number of bytes read from r to count.
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (self *countingReader) Read(p []byte) (n int, err error) {
+	n, err = self.r.Read(p)
+	atomic.AddInt64(self.count, int64(n))
+	return
+}
+
+// countingWriter adds the number of bytes written to w to count.
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (self *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = self.w.Write(p)
+	atomic.AddInt64(self.count, int64(n))
+	return
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp += 1
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
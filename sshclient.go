@@ -1,42 +1,314 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 	sshagent "golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-func getSshAgent() (agent sshagent.Agent, err error) {
-	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+var ErrNoSshAuth = errors.New("no ssh-agent (SSH_AUTH_SOCK) or private key files to authenticate with")
+
+// sshTermGrace is how long a command is given to stop after it's signalled,
+// before its session is closed.
+var sshTermGrace = 3 * time.Second
+
+// sshConnectBackoff is how long to wait before retrying a connection that
+// failed. It's doubled after each retry.
+var sshConnectBackoff = time.Second
+
+// defaultIdentityFiles are tried after any others, as ssh does.
+var defaultIdentityFiles = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+
+var (
+	keyFileSigners     = map[string]ssh.Signer{}
+	keyFileSignersLock sync.Mutex
+)
+
+var (
+	sshAgent     sshagent.Agent
+	sshAgentErr  error
+	sshAgentOnce sync.Once
+)
+
+// getSshAgent connects to the ssh-agent the first time it's called, and
+// gives the same connection after that.
+func getSshAgent() (sshagent.Agent, error) {
+	sshAgentOnce.Do(func() {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			sshAgentErr = errors.New("SSH_AUTH_SOCK not set")
+			return
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			sshAgentErr = err
+			return
+		}
+		sshAgent = sshagent.NewClient(conn)
+	})
+	return sshAgent, sshAgentErr
+}
+
+// sshSigners gives the ssh-agent's keys, if there's an agent, followed by
+// the keys in identityFiles and then fallbackFiles that exist. Encrypted keys
+// in fallbackFiles are skipped if the agent has keys, as ssh would only ask
+// for their passphrases if the agent's keys didn't work. Keys already given
+// aren't repeated, as each one offered counts against the server's limit on
+// attempts.
+func sshSigners(identityFiles []string, fallbackFiles []string) (signers []ssh.Signer, err error) {
+	if agent, err := getSshAgent(); err == nil {
+		if agentSigners, err := agent.Signers(); err == nil {
+			signers = append(signers, agentSigners...)
+		}
+	}
+	agentHasKeys := len(signers) > 0
+
+	seen := map[string]bool{}
+	for _, signer := range signers {
+		seen[string(signer.PublicKey().Marshal())] = true
+	}
+	load := func(fn string, askPassphrase bool) {
+		signer, err := loadKeyFile(fn, askPassphrase)
+		if os.IsNotExist(err) || err == errKeyEncrypted {
+			return
+		} else if err != nil {
+			log.Printf("[WARNING] couldn't load key %s: %s\n", fn, err)
+			return
+		}
+		if key := string(signer.PublicKey().Marshal()); !seen[key] {
+			seen[key] = true
+			signers = append(signers, signer)
+		}
+	}
+	for _, fn := range identityFiles {
+		load(fn, true)
+	}
+	for _, fn := range fallbackFiles {
+		load(fn, !agentHasKeys)
+	}
+
+	if len(signers) == 0 {
+		return nil, ErrNoSshAuth
+	}
+	return signers, nil
+}
+
+// errKeyEncrypted is given by loadKeyFile for an encrypted key it wasn't to
+// ask the passphrase of.
+var errKeyEncrypted = errors.New("key is encrypted")
+
+// loadKeyFile parses a private key file, asking for its passphrase if it's
+// encrypted and askPassphrase is set. Keys are cached, so each passphrase is
+// only asked for once.
+func loadKeyFile(fn string, askPassphrase bool) (signer ssh.Signer, err error) {
+	fn = expandHome(fn)
+
+	keyFileSignersLock.Lock()
+	defer keyFileSignersLock.Unlock()
+
+	if signer = keyFileSigners[fn]; signer != nil {
+		return
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+
+	signer, err = ssh.ParsePrivateKey(b)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if !askPassphrase {
+			return nil, errKeyEncrypted
+		}
+		var passphrase []byte
+		passphrase, err = readPassphrase(fn)
+		if err != nil {
+			return
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(b, passphrase)
+	}
 	if err != nil {
 		return
 	}
-	agent = sshagent.NewClient(conn)
+
+	keyFileSigners[fn] = signer
 	return
 }
 
-func sshDial(hostname string, username string) (conn *ssh.Client, err error) {
+// readPassphrase asks on the terminal, as stdin may be being sent to hosts.
+func readPassphrase(fn string) (passphrase []byte, err error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s is encrypted, and there's no terminal to ask for its passphrase", fn)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Enter passphrase for key '%s': ", fn)
+	passphrase, err = terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return
+}
+
+// sshDial connects to hostname, tunnelling through the bastion connection via
+// if it isn't nil.
+// config.Timeout limits the handshake as well as the connection. The
+// connection is closed when it runs out, rather than given a deadline, as
+// tunnelled connections don't support them.
+func sshDial(hostname string, config *ssh.ClientConfig, via *ssh.Client) (conn *ssh.Client, err error) {
+	var timedOut <-chan time.Time
+	if config.Timeout > 0 {
+		timer := time.NewTimer(config.Timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
 
-	agent, err := getSshAgent()
+	netConn, err := dialWithin(timedOut, func() (net.Conn, error) {
+		if via == nil {
+			return net.DialTimeout("tcp", hostname, config.Timeout)
+		}
+		return via.Dial("tcp", hostname)
+	})
 	if err != nil {
 		return nil, err
 	}
-	auths := []ssh.AuthMethod{
-		ssh.PublicKeysCallback(agent.Signers),
+
+	type handshake struct {
+		conn  ssh.Conn
+		chans <-chan ssh.NewChannel
+		reqs  <-chan *ssh.Request
+		err   error
 	}
+	done := make(chan handshake, 1)
+	go func() {
+		var h handshake
+		h.conn, h.chans, h.reqs, h.err = ssh.NewClientConn(netConn, hostname, config)
+		done <- h
+	}()
 
-	conn, err = ssh.Dial("tcp", hostname,
-		&ssh.ClientConfig{
-			User:            username,
-			Auth:            auths,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		})
-	return
+	select {
+	case h := <-done:
+		if h.err != nil {
+			netConn.Close()
+			return nil, h.err
+		}
+		return ssh.NewClient(h.conn, h.chans, h.reqs), nil
+	case <-timedOut:
+		// Closing the connection ends the handshake.
+		netConn.Close()
+		return nil, ErrConnectTimeout
+	}
+}
+
+// dialWithin calls dial, giving up if timedOut fires first. A connection made
+// after that is closed.
+func dialWithin(timedOut <-chan time.Time, dial func() (net.Conn, error)) (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := dial()
+		done <- dialed{conn, err}
+	}()
+
+	select {
+	case d := <-done:
+		return d.conn, d.err
+	case <-timedOut:
+		go func() {
+			if d := <-done; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ErrConnectTimeout
+	}
+}
+
+// sshDialRetrying calls sshDial, trying up to retries more times if it fails
+// with an error that may be temporary, such as the instance still booting.
+// If deadline isn't zero, each attempt's timeout is cut short at it, and
+// ErrJobTimeout is given once it's reached.
+func sshDialRetrying(hostname string, config *ssh.ClientConfig, via *ssh.Client, retries int, deadline time.Time) (conn *ssh.Client, err error) {
+	delay := sshConnectBackoff
+	for attempt := 0; ; attempt++ {
+		attemptConfig := *config
+		cappedByDeadline := false
+		if !deadline.IsZero() {
+			untilDeadline := time.Until(deadline)
+			if untilDeadline <= 0 {
+				return nil, ErrJobTimeout
+			}
+			if config.Timeout == 0 || untilDeadline < config.Timeout {
+				attemptConfig.Timeout, cappedByDeadline = untilDeadline, true
+			}
+		}
+
+		conn, err = sshDial(hostname, &attemptConfig, via)
+		if cappedByDeadline && isTimeoutError(err) {
+			return nil, ErrJobTimeout
+		}
+		if err == nil || attempt >= retries || !isTransientDialError(err) {
+			return
+		}
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isTransientDialError is whether connecting may succeed if tried again.
+// Authentication and host key errors aren't. Nor are timeouts, so that an
+// unreachable instance is given up on after the connect timeout.
+func isTransientDialError(err error) bool {
+	if isTimeoutError(err) {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	// The bastion couldn't connect to the instance.
+	if chanErr, ok := err.(*ssh.OpenChannelError); ok {
+		return chanErr.Reason == ssh.ConnectionFailed
+	}
+
+	cause := err
+	if opErr, ok := cause.(*net.OpError); ok {
+		cause = opErr.Err
+	}
+	if sysErr, ok := cause.(*os.SyscallError); ok {
+		cause = sysErr.Err
+	}
+	switch cause {
+	case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		return true
+	}
+
+	// The handshake wraps errors from the connection in its own.
+	msg := err.Error()
+	return strings.HasSuffix(msg, "EOF") || strings.Contains(msg, "connection reset by peer")
+}
+
+func isTimeoutError(err error) bool {
+	if err == ErrConnectTimeout {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 func sshRunOutput(conn *ssh.Client, cmd string) (output string, err error) {
@@ -53,16 +325,26 @@ func sshRunOutput(conn *ssh.Client, cmd string) (output string, err error) {
 	return string(b), nil
 }
 
-func sshRunOutLogger(conn *ssh.Client, cmd string, logger *log.Logger, stdinChannel chan []byte) (term chan bool, loggerReturn chan error, err error) {
+// sshRunStats counts the output of a command. It's updated as the output is
+// read, so should be read with sync/atomic.
+type sshRunStats struct {
+	BytesOut int64
+	BytesErr int64
+}
+
+// sshRunOutLogger starts cmd, calling output with what it writes to stdout or
+// stderr as it's read, and with nil data when each ends. If pty is set, a pty
+// is requested, which merges stderr into stdout. If stdin isn't nil, it's
+// copied to the command's stdin.
+func sshRunOutLogger(conn *ssh.Client, cmd string, pty bool, output func(stream string, data []byte), stdin io.Reader, stats *sshRunStats) (term chan bool, loggerReturn chan error, err error) {
 	session, err := conn.NewSession()
 	if err != nil {
 		return
 	}
 
-	if StdinIsTerminal() {
-		/* We have to request a pty so that our command exits when the session
-		* closes. Ideally we'd send a TERM signal for the Session using
-		* session.Signal(ssh.SIGTERM), but OpenSSH doesn't support that yet:
+	if pty {
+		/* We request a pty so that our command exits when the session
+		* closes, as OpenSSH before 7.9 ignores session.Signal:
 		* https://bugzilla.mindrot.org/show_bug.cgi?id=1424
 		 */
 		modes := ssh.TerminalModes{
@@ -79,12 +361,10 @@ func sshRunOutLogger(conn *ssh.Client, cmd string, logger *log.Logger, stdinChan
 		if err != nil {
 			return
 		}
-	} else {
-		logger.Println("[WARNING] pty not requested because stdin is not a terminal")
 	}
 
 	var stdinPipe io.WriteCloser
-	if stdinChannel != nil {
+	if stdin != nil {
 		stdinPipe, err = session.StdinPipe()
 		if err != nil {
 			return
@@ -95,35 +375,52 @@ func sshRunOutLogger(conn *ssh.Client, cmd string, logger *log.Logger, stdinChan
 	if err != nil {
 		return
 	}
-	stdout := channelFromReader(stdoutPipe)
+	stdout := channelFromReader(stdoutPipe, &stats.BytesOut)
 
 	stderrPipe, err := session.StderrPipe()
 	if err != nil {
 		return
 	}
-	stderr := channelFromReader(stderrPipe)
+	stderr := channelFromReader(stderrPipe, &stats.BytesErr)
 
 	err = session.Start(cmd)
 	if err != nil {
 		return
 	}
 
+	if stdin != nil {
+		// This isn't waited for, as the command may finish without reading
+		// all of its stdin. Closing the session ends the copy.
+		go func() {
+			io.Copy(stdinPipe, stdin)
+			stdinPipe.Close()
+		}()
+	}
+
 	term = make(chan bool, 1)
 	loggerReturn = make(chan error, 1)
+	done := make(chan bool)
 
 	go func() {
 		var err error // shadow outer err
-		shouldTerm := <-term
+		var shouldTerm bool
+		select {
+		case shouldTerm = <-term:
+		case <-done:
+		}
 		if shouldTerm {
-			// We can't use this, as OpenSSH doesn't support it. See above.
-			/* err = session.Signal(ssh.SIGTERM)
-			 * if err != nil {
-			 *     logger.Println("remote terminantion error: " + err.Error())
-			 * } */
-			// We have to just close the session instead.
+			// Ask the command to stop, then close the session if it hasn't,
+			// as the server may not support signals. See above.
+			if session.Signal(ssh.SIGTERM) == nil {
+				select {
+				case <-done:
+					return
+				case <-time.After(sshTermGrace):
+				}
+			}
 			err = session.Close()
 			if err != nil {
-				logger.Println("session close error: " + err.Error())
+				output(StreamStderr, []byte("session close error: "+err.Error()+"\n"))
 			}
 		}
 	}()
@@ -133,34 +430,29 @@ func sshRunOutLogger(conn *ssh.Client, cmd string, logger *log.Logger, stdinChan
 
 		for {
 			select {
-			case inBytes, ok := <-stdinChannel:
+			case data, ok := <-stdout:
 				if ok {
-					stdinPipe.Write(inBytes)
-				} else {
-					stdinPipe.Close()
-					stdinChannel = nil
-				}
-			case line, ok := <-stdout:
-				if ok {
-					logger.Println(line)
+					output(StreamStdout, data)
 				} else {
+					output(StreamStdout, nil)
 					stdout = nil
 				}
-			case line, ok := <-stderr:
+			case data, ok := <-stderr:
 				if ok {
-					logger.Println(line)
+					output(StreamStderr, data)
 				} else {
+					output(StreamStderr, nil)
 					stderr = nil
 				}
 			}
 
-			if stdinChannel == nil && stdout == nil && stderr == nil {
+			if stdout == nil && stderr == nil {
 				break
 			}
 		}
 
 		err := session.Wait()
-		close(term)
+		close(done)
 
 		if exitError, ok := err.(*ssh.ExitError); ok && exitError.Signal() == "HUP" {
 			err = nil
@@ -172,25 +464,18 @@ func sshRunOutLogger(conn *ssh.Client, cmd string, logger *log.Logger, stdinChan
 	return
 }
 
-func cleanOutputLine(line string) (out []string) {
-	line = strings.TrimSpace(line)
-	line = strings.Replace(line, "\r", "\n", -1)
-	line = strings.Replace(line, "\n\n", "\n", -1)
-	return strings.Split(line, "\n")
-}
-
-func channelFromReader(pipe io.Reader) (ch chan string) {
-	ch = make(chan string)
+// channelFromReader sends what's read from pipe, as it's read, closing the
+// channel at the end.
+func channelFromReader(pipe io.Reader, byteCount *int64) (ch chan []byte) {
+	ch = make(chan []byte)
 
 	go func() {
-		reader := bufio.NewReader(pipe)
 		for {
-			in, err := reader.ReadString('\n')
-			if (err == io.EOF && in != "") || err == nil {
-				lines := cleanOutputLine(in)
-				for _, line := range lines {
-					ch <- line
-				}
+			buf := make([]byte, 32*1024)
+			n, err := pipe.Read(buf)
+			atomic.AddInt64(byteCount, int64(n))
+			if n > 0 {
+				ch <- buf[:n]
 			}
 
 			if err != nil {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfigFile is the subset of ~/.ssh/config that moltar understands: Host
+// blocks and the options in them. Match and Include are ignored.
+type sshConfigFile struct {
+	entries []sshConfigEntry
+}
+
+type sshConfigEntry struct {
+	patterns []string
+	options  map[string][]string
+}
+
+func defaultSshConfigFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "config")
+}
+
+// loadSshConfig parses the ssh config file fn. A missing file is treated as
+// an empty one.
+func loadSshConfig(fn string) (config *sshConfigFile, err error) {
+	config = &sshConfigFile{}
+
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Options before the first Host line apply to every host.
+	entry := &sshConfigEntry{patterns: []string{"*"}, options: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		key, value := splitSshConfigLine(line)
+		switch key {
+		case "host":
+			config.entries = append(config.entries, *entry)
+			entry = &sshConfigEntry{patterns: strings.Fields(value),
+				options: map[string][]string{}}
+		case "match":
+			config.entries = append(config.entries, *entry)
+			entry = &sshConfigEntry{options: map[string][]string{}}
+		default:
+			entry.options[key] = append(entry.options[key], value)
+		}
+	}
+	config.entries = append(config.entries, *entry)
+
+	return config, scanner.Err()
+}
+
+func splitSshConfigLine(line string) (key string, value string) {
+	i := strings.IndexAny(line, " \t=")
+	if i == -1 {
+		return strings.ToLower(line), ""
+	}
+	key = strings.ToLower(line[:i])
+	value = strings.TrimSpace(line[i+1:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	value = strings.Trim(value, `"`)
+	return
+}
+
+// Get gives the first value of key for a host known by any of names, as ssh
+// does, or "" if there isn't one.
+func (self *sshConfigFile) Get(key string, names ...string) string {
+	if values := self.GetAll(key, names...); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// GetAll gives every value of key for a host known by any of names, in the
+// order they appear. Options such as IdentityFile may be given many times.
+func (self *sshConfigFile) GetAll(key string, names ...string) (values []string) {
+	key = strings.ToLower(key)
+	for _, entry := range self.entries {
+		if entry.matches(names) {
+			values = append(values, entry.options[key]...)
+		}
+	}
+	return
+}
+
+func (self *sshConfigEntry) matches(names []string) bool {
+	matched := false
+	for _, pattern := range self.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// StateFile records the last exec, deploy or other command run on instances,
+// and its result on each, for the retry command and -only-failed. It's kept
+// in the project directory, as stateFilePath gives.
+const StateFile = ".moltar-state"
+
+const cmdRetry = "retry"
+
+// runState is a run of a command on instances, with what was used to find
+// them and run on it, so that retry can do the same again.
+type runState struct {
+	Time               time.Time      `json:"time"`
+	Env                string         `json:"env"`
+	Cluster            string         `json:"cluster"`
+	Command            string         `json:"command"`
+	Args               []string       `json:"args"`
+	Version            string         `json:"version,omitempty"`
+	Project            string         `json:"project"`
+	AllProjects        bool           `json:"all_projects,omitempty"`
+	PackageNames       []string       `json:"package_names,omitempty"`
+	FilterPackageNames []string       `json:"filter_package_names,omitempty"`
+	Options            ExecOptions    `json:"options"`
+	Hosts              []runStateHost `json:"hosts"`
+}
+
+type runStateHost struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// stateFilePath is in the directory of the config file, or if there isn't
+// one, of the project dotfile, so that it's the same wherever in the project
+// moltar is run. Failing both, it's in the current directory.
+func stateFilePath(config *Config) string {
+	if config.Dir != "" {
+		return filepath.Join(config.Dir, StateFile)
+	}
+	if dir, err := findProjectDir(); err == nil {
+		return filepath.Join(dir, StateFile)
+	}
+	return StateFile
+}
+
+func loadRunState(fn string) (state *runState, err error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("there's no previous run to go on, as %s doesn't exist", fn)
+	} else if err != nil {
+		return
+	}
+
+	state = &runState{}
+	if err = json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("couldn't read %s: %s", fn, err)
+	}
+	return
+}
+
+// restoreFlags sets the flags that choose the instances and how to run on them
+// back to what they were in the last run, unless they're given again.
+func (self *runState) restoreFlags() {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	restore := map[string]string{
+		"project":         self.Project,
+		"all-projects":    strconv.FormatBool(self.AllProjects),
+		"version":         self.Version,
+		"parallel":        strconv.Itoa(self.Options.Parallel),
+		"batch":           self.Options.BatchSize,
+		"batch-pause":     self.Options.BatchPause.String(),
+		"command-timeout": self.Options.CommandTimeout.String(),
+		"timeout":         self.Options.Timeout.String(),
+		"no-tty":          strconv.FormatBool(self.Options.NoTty),
+		"template":        strconv.FormatBool(self.Options.Template),
+	}
+	if !given["parallel"] && given["s"] {
+		// -s is given as parallel, so it's what was given that counts.
+		delete(restore, "parallel")
+	}
+	for name, value := range restore {
+		if !given[name] {
+			flag.Set(name, value)
+		}
+	}
+}
+
+// save records results in the state file fn, replacing what was there.
+func (self *runState) save(fn string, results []*ExecResult) error {
+	self.Time = time.Now()
+	self.Hosts = make([]runStateHost, len(results))
+	for i, result := range results {
+		self.Hosts[i] = runStateHost{Id: result.Host.Id, Name: instanceLogName(result.Host),
+			Status: result.Status()}
+		if result.Err != nil {
+			self.Hosts[i].Error = result.Err.Error()
+		}
+	}
+
+	b, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so a failed write doesn't lose the
+	// last state.
+	tmp := fn + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// FailedIds gives the instances that didn't succeed: those that failed, were
+// unreachable, or weren't run or finished.
+func (self *runState) FailedIds() (ids []string) {
+	for _, host := range self.Hosts {
+		if host.Status != ResultOk {
+			ids = append(ids, host.Id)
+		}
+	}
+	return
+}
+
+// OnlyInstances restricts the job to the instances with the given IDs.
+func (self *Job) OnlyInstances(ids []string) error {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	instances := make([]*Host, 0, len(ids))
+	for _, instance := range self.instances {
+		if wanted[instance.Id] {
+			instances = append(instances, instance)
+		}
+	}
+	if len(instances) == 0 {
+		return errors.New("no instances failed in the last run, or they've all gone")
+	}
+	self.instances = instances
+	return nil
+}
@@ -2,64 +2,216 @@ package main
 
 import (
 	"github.com/kless/term"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync"
 	"syscall"
 )
 
-var (
-	stdinReading  bool
-	stdinChannels [](chan []byte)
-	stdinWait     sync.WaitGroup
+// stdinChunkSize is how much of stdin is read at a time, and stdinBacklog how
+// many chunks an instance may fall behind by before reading stdin waits for
+// it.
+const (
+	stdinChunkSize = 32 * 1024
+	stdinBacklog   = 16
 )
 
 func StdinIsTerminal() bool {
 	return term.IsTerminal(syscall.Stdin)
 }
 
-func makeStdinChannel() (chanOut chan []byte) {
-	if stdinReading {
-		panic("already reading stdin")
-	}
-	chanOut = make(chan []byte)
-	stdinChannels = append(stdinChannels, chanOut)
-	return
+// isTerminal is whether w is a file open on a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// stdinSource gives each instance that runs a command its own copy of
+// moltar's stdin.
+type stdinSource interface {
+	// Open gives a reader for an instance that's about to run its command.
+	// It must be closed once the command has finished.
+	Open() (io.ReadCloser, error)
+	// Skip is called instead of Open by an instance that won't run its
+	// command, as it couldn't be connected to, say.
+	Skip()
 }
 
-func closeAllStdinChannels() {
-	for _, ch := range stdinChannels {
-		close(ch)
+// newStdinSource gives a source of r for n instances. If they all run at
+// once, r is streamed to them as it's read. Otherwise, it's read in full
+// first, so that it can be replayed to instances as they start.
+func newStdinSource(r io.Reader, n int, streaming bool) stdinSource {
+	if streaming {
+		return newStdinFanout(r, n)
 	}
+	return &stdinSpool{r: r}
+}
+
+/// Streaming
+
+// stdinFanout sends each chunk read from stdin to every instance. Reading
+// starts once every instance has opened or skipped it, so none miss the
+// start. Each instance has its own backlog, and one that finishes early is
+// dropped rather than holding up the others.
+type stdinFanout struct {
+	r       io.Reader
+	waiting int
+	sinks   map[*stdinSink]bool
+	ended   bool
+	ready   chan bool
+	lock    sync.Mutex
+}
+
+// stdinSink is an instance's copy of stdin.
+type stdinSink struct {
+	ch        chan []byte
+	done      chan bool
+	closeOnce sync.Once
+	buf       []byte
 }
 
-func StartStdinRead() {
-	if !StdinIsTerminal() {
-		stdinWait.Done()
+func newStdinFanout(r io.Reader, n int) *stdinFanout {
+	fanout := &stdinFanout{r: r, waiting: n, sinks: map[*stdinSink]bool{},
+		ready: make(chan bool)}
+	if n == 0 {
+		close(fanout.ready)
 	}
+	go fanout.run()
+	return fanout
 }
 
-func WaitForStdinStart(n int) {
-	if StdinIsTerminal() {
-		closeAllStdinChannels()
-		return
+func (self *stdinFanout) Open() (io.ReadCloser, error) {
+	sink := &stdinSink{ch: make(chan []byte, stdinBacklog), done: make(chan bool)}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.ended {
+		close(sink.ch)
+	} else {
+		self.sinks[sink] = true
 	}
+	self.started()
+	return sink, nil
+}
 
-	stdinWait.Add(n)
-	// FIXME: There's probably a deadlock here if some hosts error
-	stdinWait.Wait()
+func (self *stdinFanout) Skip() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.started()
+}
+
+// started counts off an instance. The caller must hold the lock.
+func (self *stdinFanout) started() {
+	self.waiting -= 1
+	if self.waiting == 0 {
+		close(self.ready)
+	}
+}
 
-	stdinReading = true
+func (self *stdinFanout) run() {
+	<-self.ready
 
-	bs := make([]byte, 256)
 	for {
-		n, err := os.Stdin.Read(bs)
+		sinks := self.liveSinks()
+		if len(sinks) == 0 {
+			// Nobody's listening, so leave stdin be.
+			self.end()
+			return
+		}
+
+		buf := make([]byte, stdinChunkSize)
+		n, err := self.r.Read(buf)
 		if n > 0 {
-			for _, ch := range stdinChannels {
-				ch <- bs
+			for _, sink := range sinks {
+				select {
+				case sink.ch <- buf[:n]:
+				case <-sink.done:
+				}
 			}
-		} else if n == 0 || err != nil {
-			closeAllStdinChannels()
+		}
+		if err != nil {
+			self.end()
 			return
 		}
 	}
 }
+
+// liveSinks gives the sinks that haven't been closed, forgetting the rest.
+func (self *stdinFanout) liveSinks() (sinks []*stdinSink) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for sink := range self.sinks {
+		select {
+		case <-sink.done:
+			delete(self.sinks, sink)
+		default:
+			sinks = append(sinks, sink)
+		}
+	}
+	return
+}
+
+func (self *stdinFanout) end() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ended = true
+	for sink := range self.sinks {
+		close(sink.ch)
+	}
+	self.sinks = nil
+}
+
+func (self *stdinSink) Read(p []byte) (n int, err error) {
+	if len(self.buf) == 0 {
+		select {
+		case data, ok := <-self.ch:
+			if !ok {
+				return 0, io.EOF
+			}
+			self.buf = data
+		case <-self.done:
+			return 0, io.EOF
+		}
+	}
+	n = copy(p, self.buf)
+	self.buf = self.buf[n:]
+	return
+}
+
+func (self *stdinSink) Close() error {
+	self.closeOnce.Do(func() { close(self.done) })
+	return nil
+}
+
+/// Spooled
+
+// stdinSpool reads stdin into a temporary file the first time it's opened,
+// and gives each instance a reader from the start of it.
+type stdinSpool struct {
+	r    io.Reader
+	once sync.Once
+	file *os.File
+	size int64
+	err  error
+}
+
+func (self *stdinSpool) Open() (io.ReadCloser, error) {
+	self.once.Do(self.spool)
+	if self.err != nil {
+		return nil, self.err
+	}
+	return ioutil.NopCloser(io.NewSectionReader(self.file, 0, self.size)), nil
+}
+
+func (self *stdinSpool) Skip() {}
+
+func (self *stdinSpool) spool() {
+	self.file, self.err = ioutil.TempFile("", "moltar-stdin")
+	if self.err != nil {
+		return
+	}
+	// The file is only needed while moltar's running.
+	os.Remove(self.file.Name())
+	self.size, self.err = io.Copy(self.file, self.r)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// dirSync is a local directory to make a remote one the same as, by copying
+// only the files that differ.
+type dirSync struct {
+	localDir  string
+	remoteDir string
+	checksum  bool
+	delete    bool
+	dryRun    bool
+	// files are the local directory's regular files, and dirs its
+	// subdirectories, by their slash-separated paths relative to it.
+	files map[string]os.FileInfo
+	dirs  map[string]os.FileInfo
+	// sums are the SHA-256 checksums of the local files, if checksum is set.
+	sums map[string]string
+}
+
+// parseSyncArgs reads the arguments to the sync command: the local
+// directory, then :REMOTEDIR, with -c to compare checksums, -delete to
+// delete remote files that aren't local, and -n for a dry run.
+func parseSyncArgs(args []string) (ds *dirSync, err error) {
+	ds = &dirSync{}
+	var paths []string
+	for _, arg := range args {
+		switch {
+		case arg == "":
+			return nil, errors.New("empty directory name given")
+		case arg == "-c":
+			ds.checksum = true
+		case arg == "-delete":
+			ds.delete = true
+		case arg == "-n":
+			ds.dryRun = true
+		case arg[0] == '-':
+			return nil, fmt.Errorf("unknown sync option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) != 2 || paths[0][0] == ':' || paths[1][0] != ':' {
+		return nil, errors.New("you must give a local directory and then a remote one, beginning with ':'")
+	}
+	ds.localDir = paths[0]
+	// Relative paths are from the user's home directory.
+	ds.remoteDir = path.Clean(paths[1][1:])
+
+	if err = ds.scanLocal(); err != nil {
+		return nil, err
+	}
+	if ds.delete && !ds.dryRun && len(ds.files) == 0 && len(ds.dirs) == 0 {
+		return nil, fmt.Errorf("%s is empty, so -delete would delete everything in %s; use -n to see what would be deleted",
+			ds.localDir, ds.remoteDir)
+	}
+	return ds, nil
+}
+
+func (self *dirSync) scanLocal() error {
+	// The directory may be a symlink, such as to the current release, which
+	// Walk wouldn't go into.
+	root, err := filepath.EvalSymlinks(self.localDir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", self.localDir)
+	}
+	self.localDir = root
+
+	self.files = map[string]os.FileInfo{}
+	self.dirs = map[string]os.FileInfo{}
+	self.sums = map[string]string{}
+	return filepath.Walk(self.localDir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(self.localDir, fn)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case info.IsDir():
+			self.dirs[rel] = info
+		case info.Mode().IsRegular():
+			self.files[rel] = info
+			if self.checksum {
+				self.sums[rel], err = sha256File(fn)
+			}
+		}
+		return err
+	})
+}
+
+func sha256File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Sync makes a directory on each instance the same as a local one over SFTP,
+// copying only the files that differ, and gives the result on each.
+func (self *Job) Sync(args []string, opts ExecOptions) (results []*ExecResult, err error) {
+	ds, err := parseSyncArgs(args)
+	if err != nil {
+		return
+	}
+
+	results, err = self.execBatches(opts, func(batch []*Host) []*ExecResult {
+		return self.runOn(batch, opts, func(instance *Host, index int) *ExecResult {
+			return self.sftpTransfer(instance, opts, 0, ds.run)
+		})
+	})
+	return
+}
+
+// run compares the remote directory with the local one, by size and
+// modification time or by checksum, and copies the files that differ. With
+// delete, remote files and directories that aren't local are deleted. With
+// dryRun, what would be done is only reported.
+func (self *dirSync) run(conn *ssh.Client, client *sftp.Client, progress *transferProgress) error {
+	remoteFiles, remoteDirs, err := self.scanRemote(client)
+	if err != nil {
+		return err
+	}
+
+	var remoteSums map[string]string
+	if self.checksum && len(remoteFiles) > 0 {
+		if remoteSums, err = self.remoteChecksums(conn); err != nil {
+			return err
+		}
+	}
+
+	var copies []string
+	var total int64
+	for rel, info := range self.files {
+		remote, ok := remoteFiles[rel]
+		switch {
+		case !ok:
+		case !remote.Mode().IsRegular():
+		case remote.Size() != info.Size():
+		case self.checksum && remoteSums[rel] != self.sums[rel]:
+		case !self.checksum && remote.ModTime().Unix() != info.ModTime().Unix():
+		default:
+			continue
+		}
+		copies = append(copies, rel)
+		total += info.Size()
+	}
+	sort.Strings(copies)
+	progress.setTotal(total)
+
+	var deletes []string
+	if self.delete {
+		for rel := range remoteFiles {
+			// Those where there's a local directory are replaced by it.
+			_, isDir := self.dirs[rel]
+			if _, ok := self.files[rel]; !ok && !isDir {
+				deletes = append(deletes, rel)
+			}
+		}
+		for rel := range remoteDirs {
+			if _, ok := self.dirs[rel]; !ok {
+				deletes = append(deletes, rel)
+			}
+		}
+		// Reversed, so directories come after what's in them.
+		sort.Sort(sort.Reverse(sort.StringSlice(deletes)))
+	}
+
+	if self.dryRun {
+		for _, rel := range copies {
+			progress.output(fmt.Sprintf("would copy %s (%s)", rel, formatBytes(self.files[rel].Size())))
+		}
+		for _, rel := range deletes {
+			progress.output("would delete " + rel)
+		}
+		progress.output(fmt.Sprintf("%d to copy (%s), %d to delete, %d unchanged",
+			len(copies), formatBytes(total), len(deletes), len(self.files)-len(copies)))
+		return nil
+	}
+
+	if err := self.makeRemoteDirs(client, remoteFiles, remoteDirs); err != nil {
+		return err
+	}
+	for _, rel := range copies {
+		fn := filepath.Join(self.localDir, filepath.FromSlash(rel))
+		remote := path.Join(self.remoteDir, rel)
+		if err := removeIrregular(client, remote, remoteFiles[rel]); err != nil {
+			return err
+		}
+		if err := sftpCopyFile(client, fn, remote, self.files[rel], progress); err != nil {
+			return err
+		}
+	}
+	for _, rel := range deletes {
+		remote := path.Join(self.remoteDir, rel)
+		if _, isDir := remoteDirs[rel]; isDir {
+			err = client.RemoveDirectory(remote)
+		} else {
+			err = client.Remove(remote)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", remote, err)
+		}
+		progress.output("deleted " + remote)
+	}
+
+	progress.output(fmt.Sprintf("%d copied (%s), %d deleted, %d unchanged",
+		len(copies), formatBytes(total), len(deletes), len(self.files)-len(copies)))
+	return nil
+}
+
+// scanRemote gives the files and subdirectories in the remote directory, by
+// their paths relative to it. If it doesn't exist, there are none.
+func (self *dirSync) scanRemote(client *sftp.Client) (files map[string]os.FileInfo, dirs map[string]os.FileInfo, err error) {
+	files = map[string]os.FileInfo{}
+	dirs = map[string]os.FileInfo{}
+
+	info, err := client.Stat(self.remoteDir)
+	if os.IsNotExist(err) {
+		return files, dirs, nil
+	} else if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return nil, nil, fmt.Errorf("%s isn't a directory", self.remoteDir)
+	}
+
+	root, err := resolveRemoteSymlinks(client, self.remoteDir)
+	if err != nil {
+		return
+	}
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err = walker.Err(); err != nil {
+			return
+		}
+		rel := walker.Path()
+		if root != "." {
+			rel = strings.TrimPrefix(rel, strings.TrimSuffix(root, "/")+"/")
+		}
+		switch {
+		case walker.Path() == root:
+		case walker.Stat().IsDir():
+			dirs[rel] = walker.Stat()
+		default:
+			// Anything else, such as a symlink, is treated as a file. It's
+			// removed before a local file or directory is copied over it, as
+			// writing to it would write to wherever it points.
+			files[rel] = walker.Stat()
+		}
+	}
+	return
+}
+
+// remoteChecksums runs sha256sum over the remote directory's files.
+func (self *dirSync) remoteChecksums(conn *ssh.Client) (sums map[string]string, err error) {
+	output, err := sshRunOutput(conn, "cd "+shellQuote(self.remoteDir)+
+		" && find . -type f -exec sha256sum {} +")
+	if err != nil {
+		return nil, fmt.Errorf("checksumming %s: %s", self.remoteDir, err)
+	}
+
+	sums = map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) == 2 {
+			sums[strings.TrimPrefix(parts[1], "./")] = parts[0]
+		}
+	}
+	return sums, scanner.Err()
+}
+
+// makeRemoteDirs makes the local subdirectories that are missing remotely,
+// including the remote directory itself.
+func (self *dirSync) makeRemoteDirs(client *sftp.Client, remoteFiles map[string]os.FileInfo, remoteDirs map[string]os.FileInfo) error {
+	if err := client.MkdirAll(self.remoteDir); err != nil {
+		return err
+	}
+
+	rels := make([]string, 0, len(self.dirs))
+	for rel := range self.dirs {
+		if _, ok := remoteDirs[rel]; !ok {
+			rels = append(rels, rel)
+		}
+	}
+	// Sorted, so parents are made before what's in them.
+	sort.Strings(rels)
+	for _, rel := range rels {
+		remote := path.Join(self.remoteDir, rel)
+		if _, ok := remoteFiles[rel]; ok {
+			// A file or symlink is in the way.
+			if err := client.Remove(remote); err != nil {
+				return fmt.Errorf("%s: %s", remote, err)
+			}
+		}
+		if err := client.Mkdir(remote); err != nil {
+			return fmt.Errorf("%s: %s", remote, err)
+		}
+		if err := client.Chmod(remote, self.dirs[rel].Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIrregular removes a remote symlink or other file that isn't a regular
+// one, given its Lstat info, so that what's copied replaces it rather than
+// being written through it. info is nil if there's nothing there.
+func removeIrregular(client *sftp.Client, remote string, info os.FileInfo) error {
+	if info == nil || info.Mode().IsRegular() {
+		return nil
+	}
+	if err := client.Remove(remote); err != nil {
+		return fmt.Errorf("%s: %s", remote, err)
+	}
+	return nil
+}
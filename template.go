@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// commandFunc gives the command to run on an instance, given its index among
+// those being run on at the same time.
+type commandFunc func(instance *Host, index int) (string, error)
+
+// templateData is what's available to templates in exec commands and scp
+// destinations: the fields of the Host, such as .Name, .PrivateIp and
+// .Tags.Name, and .Instance for instances found in EC2, along with .Index.
+type templateData struct {
+	*Host
+	// Index is the instance's position among those being run on at the same
+	// time, from 0: in its batch, or in the whole job without batches.
+	Index int
+}
+
+func fixedCommand(cmd string) commandFunc {
+	return func(*Host, int) (string, error) {
+		return cmd, nil
+	}
+}
+
+func parseHostTemplate(text string) (*template.Template, error) {
+	return template.New("").Option("missingkey=zero").Parse(text)
+}
+
+// templateCommand expands the template text for each instance.
+func templateCommand(text string) (commandFunc, error) {
+	tmpl, err := parseHostTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	return func(instance *Host, index int) (string, error) {
+		return expandHostTemplate(tmpl, instance, index)
+	}, nil
+}
+
+func expandHostTemplate(tmpl *template.Template, instance *Host, index int) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, templateData{Host: instance, Index: index}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -7,7 +7,7 @@ import (
 
 const moltarUsage = `Usage:
 
-moltar [-project=PROJECT] [-p] [-package=PACKAGE] ENV CMD
+moltar [-project=PROJECT] [-all-projects] [-p] [-package=PACKAGE] ENV CMD
 
   -project=PROJECT
 
@@ -15,6 +15,11 @@ moltar [-project=PROJECT] [-p] [-package=PACKAGE] ENV CMD
     use the supplied name. This will also disable looking AWS credentials up
     by the value of AWS_DEFAULT_PROFILE.
 
+  -all-projects
+
+    Don't filter instances by their Project tag. Every instance the AWS
+    credentials can see is considered, so take care with exec and deploy.
+
   -p
  
     Filter instance selection by matching detected or given package names to
@@ -31,6 +36,167 @@ moltar [-project=PROJECT] [-p] [-package=PACKAGE] ENV CMD
     Install specified version of the package(s) instead of the latest.
     Useful for rolling back.
 
+  -s
+
+    Run exec commands and deploys on one instance at a time. The same as
+    -parallel=1.
+
+  -parallel=N
+
+    Run exec commands and deploys on at most N instances at once. The default
+    is to run on all of them at once.
+
+  -batch=SIZE
+
+    Roll exec commands and deploys through the instances in batches of SIZE,
+    which is a number of instances or a percentage of them, such as 25%. Each
+    batch must succeed before the next is started; if one fails, the rest
+    aren't run. A deploy runs all of its commands on a batch before moving on
+    to the next.
+
+  -batch-pause=DURATION
+
+    Wait for DURATION, such as 30s or 2m, between batches.
+
+  -connect-timeout=DURATION
+
+    Give up connecting to an instance after DURATION. The default is 30s.
+
+  -connect-retries=N
+
+    Try connecting to an instance up to N more times if it fails with a
+    network error, such as the connection being refused or reset, or the
+    bastion failing to connect to it, waiting 1s before the first retry and
+    twice as long before each one after. The default is 2. Timeouts aren't
+    retried, so -connect-timeout still limits how long an unreachable
+    instance takes, and nor are authentication and host key errors.
+
+  -command-timeout=DURATION
+
+    Give up on a command that's still running on an instance after DURATION.
+    Its session is closed, and the instance reported as timed out.
+
+  -timeout=DURATION
+
+    Give up on the whole exec or deploy after DURATION. Commands still running
+    are stopped as with -command-timeout, and instances still being connected
+    to or not yet started are reported as timed out.
+
+  -output=FORMAT
+
+    text (the default), grouped, raw or json. text prints each line of
+    output as it arrives, prefixed by its instance's name; lines from stderr
+    go to moltar's stderr, with the name in red on a terminal. Lines are
+    printed as they are, and the prefix is repeated after a carriage return,
+    so progress bars still work.
+
+    raw passes the output through exactly, with no prefix, which is most
+    useful with a single instance. Everything else moltar prints goes to
+    stderr.
+
+    grouped waits until every instance has finished, then prints the output
+    once for each group of instances whose output and result were identical,
+    with the instances listed above it. The largest group comes first; the
+    rest are marked as differing from it.
+
+    With json, ls and hostname print the instances as JSON, including every
+    address and tag, and exec, deploy and install print a JSON object per
+    line: one for each message and line of output, with "type", "host",
+    "id", "stream" (stdout or stderr) and "line", and finally one with
+    "type": "result" for each instance, giving its "status", "exit_status",
+    "signal", "duration" in seconds, "bytes_out", "bytes_err" and "error".
+
+  -no-tty
+
+    Don't request a pty for exec, deploy and install, even when stdin is a
+    terminal. With a pty, commands' stderr is merged into their stdout; this
+    keeps them apart. Without one, a command may keep running on the
+    instance after it times out or moltar is stopped.
+
+  -template
+
+    Expand exec commands and scp destinations as templates for each host,
+    as described under exec. It's off by default, so that commands
+    containing {{, such as docker's --format options, are sent as they are.
+
+  -outdir=DIR
+
+    As well as printing the output of exec, deploy, install, run, scp, sync
+    and fetch, write each instance's stdout and stderr to DIR/NAME.out and
+    DIR/NAME.err, and its result, including the exit status, to
+    DIR/NAME.json. For scp, sync and fetch, the output is the files copied.
+    NAME is the instance's name, followed by its ID if the name isn't unique.
+    DIR is created if need be, and existing files are overwritten.
+
+  -only-failed
+
+    Only use the instances that didn't succeed in the last exec, run, deploy,
+    install, scp, sync or fetch in the same environment and cluster: those
+    that failed, were unreachable, were interrupted, were left incomplete or
+    weren't run. Unlike the retry command, this can be given with any
+    command.
+
+  -address=ADDRESS
+
+    Which of each instance's addresses to connect to: public-dns (the
+    default), public-ip, private-dns or private-ip. If an instance doesn't
+    have that kind of address, the first one it has is used instead.
+
+  -bastion=BASTION
+
+    Connect to instances through a bastion (jump host). BASTION is either
+    [USER@]HOST[:PORT], or criteria as given to the ssh command, such as
+    cluster=bastion, to find the bastion among the project's instances. The
+    bastion itself is always reached by its public address, and isn't one of
+    the instances run on unless its cluster is the one given.
+
+  -i=KEYFILE
+
+    Authenticate with the private key in KEYFILE, as well as any keys in
+    ssh-agent. moltar also tries the IdentityFile entries for each instance
+    in ~/.ssh/config, and then ~/.ssh/id_rsa, id_ecdsa and id_ed25519. The
+    User and Port entries there are used too; Host patterns are matched
+    against an instance's address and its name. You'll be asked for the
+    passphrase of encrypted keys, though those found in ~/.ssh are skipped if
+    ssh-agent has keys.
+
+  -host-keys=POLICY
+
+    How to verify the host keys of instances. Keys are looked up in
+    ~/.ssh/known_hosts and moltar's own ~/.moltar/known_hosts. POLICY is what
+    to do with an instance that isn't in either:
+
+    tofu     trust it the first time, and add it to moltar's known_hosts
+             (the default)
+    strict   refuse to connect
+    console  check it against the keys in the instance's EC2 console output,
+             and add it to moltar's known_hosts if it matches; hosts that
+             aren't EC2 instances, such as a bastion given by its address,
+             are trusted the first time
+
+    A host whose key has changed is always refused. The ssh command, and
+    the ssh it reaches a bastion with, are given the same known_hosts files.
+
+  -hosts-file=FILE
+
+    Don't look instances up in EC2; read them from FILE instead. FILE is a
+    YAML list of hosts, or JSON if its name ends in .json, for example:
+
+    - name: vm1
+      public_ip: 192.168.56.10
+      port: 2222
+      ssh_user: vagrant
+      tags: {Environment: qa, Cluster: web, Packages: "|myapp|"}
+
+    Hosts are selected by their tags the same way as EC2 instances are,
+    except that hosts without a Project tag aren't filtered by project.
+
+  -hosts-command=CMD
+
+    As -hosts-file, but the hosts are read as JSON from the output of the
+    shell command CMD. The command is given MOLTAR_PROJECT, MOLTAR_ENV,
+    MOLTAR_CLUSTER and MOLTAR_PACKAGE in its environment.
+
 ENV is at least one of the environment (production, staging, qa etc) and
 the cluster (web, worker, search etc), separated by a slash '/'. Either or both
 may be ommitted, as long as the slash remains. The slash may be ommitted if
@@ -45,7 +211,7 @@ only the environment is given. So the following are valid:
 
 Note that instances are still filtered by their Project tag, which must match
 the project name given in the .project-name or .moltar-project file in the
-current directory.
+current directory (or by -project), unless -all-projects is given.
 
 Where CMD is one of:
 
@@ -53,6 +219,48 @@ Where CMD is one of:
 
     CMD is the command to be run on all hosts, with results reported back
 
+    With -template, CMD is a Go template (see
+    https://golang.org/pkg/text/template/), expanded for each host, so it
+    can use the host's details: .Id, .Name, .PublicDns, .PublicIp,
+    .PrivateDns, .PrivateIp, .AvailabilityZone, .Region, .Account, .ImageId,
+    .KeyName, .SshUser, its tags as .Tags.NAME (or with index .Tags "NAME"
+    for names that aren't identifiers), and for EC2 instances, the whole
+    instance as described by the EC2 API as .Instance. .Index is the host's
+    position in its batch, counting from 0; hosts are ordered by name. For
+    example:
+
+    moltar -template prod exec 'echo {{.Tags.Name}} > /etc/hostname'
+    moltar -template prod exec 'echo {{.Instance.Placement.AvailabilityZone}}'
+
+    With -template, write {{"{{"}} for a literal {{.
+
+    If moltar's stdin isn't a terminal, each host is given a copy of it, for
+    example:
+
+    cat dump.sql | moltar qa/db exec psql
+
+    When every host runs at once, stdin is streamed to them as it's read.
+    With -s, -parallel or -batch, it's read in full first, and then given to
+    each host as it starts.
+
+  run [-sudo] [-interpreter=INTERPRETER] [-tmpdir=DIR] [-e NAME=VALUE...] SCRIPT [ARG...]
+
+    Runs the local file SCRIPT on all hosts, with the given ARGs, and reports
+    the results as exec does. The script is sent over each host's session
+    and saved to a temporary file in DIR, which defaults to $TMPDIR or /tmp,
+    so it may be as long and use as much quoting as you like. Give -tmpdir
+    if /tmp is mounted noexec. The file is deleted once the script has run.
+    If it times out or moltar is interrupted, the script is stopped and the
+    file deleted straight away, as long as the host's sshd passes on signals
+    (OpenSSH 7.9 or later); otherwise the script carries on, and the file is
+    deleted when it finishes. It's run by its #! line, or by INTERPRETER if
+    that's given, as root with -sudo, and with each NAME=VALUE given by -e in
+    its environment. For example:
+
+    moltar prod/db run -sudo -e DRY_RUN=1 ./migrate.sh --verbose
+
+    The script's stdin is empty, and no pty is requested.
+
   ssh NAME [ARG...]
 
     NAME is a string that uniquely identifies an instance. This can be part of
@@ -68,27 +276,79 @@ Where CMD is one of:
     (in this case part of the instance ID), and '53' (part of the public DNS
     name).
 
+    A part of NAME of the form KEY=VALUE only matches the tag KEY, where KEY
+    may also be one of project, env, cluster, packages or name to use the tag
+    configured for that in .moltar-config. For example:
+
+    moltar / ssh cluster=web/34a
+
     moltar qa/web ssh -1
 
     will open an ssh session on the first-encountered instance filtered by the
     given environment and cluster. Note this may change between calls to
     moltar, depending on the order instances are returned from the AWS API.
 
-  scp FILE [FILE...]
+  scp [-r] FILE [FILE...] [:DEST]
 
-    FILE is either a local file, or begins with a colon ':' and refers to a
-    remote file. For example:
+    Copies local FILEs to each host over SFTP, on the same connections as
+    exec, so the same keys, users, bastion and host key checks are used.
+    DEST begins with a colon ':' and is the remote file or directory to copy
+    to; it defaults to the user's home directory, and relative paths are
+    from there too. With -template, DEST is a template, as for exec. With
+    -r, directories are copied recursively. Modes and modification times are
+    kept. For example:
 
-    moltar scp hello.jpg
+    moltar qa scp hello.jpg
     # Copies local 'hello.jpg' to the home folder of the default user on each
     # host.
 
-    moltar scp bunnies.png :/var/www/public/
+    moltar qa scp bunnies.png :/var/www/public/
     # Copies local 'bunnies.png' to given directory on each host.
 
+    moltar qa scp -r static :/var/www/public/
+    # Copies the local 'static' directory into the given directory.
+
+    Each file copied is reported, along with progress on long copies. As
+    with exec, -s, -parallel, -batch and the timeouts apply, a summary is
+    printed at the end, and the exit status is the same.
+
+  sync [-c] [-delete] [-n] LOCALDIR :REMOTEDIR
+
+    Makes REMOTEDIR on each host the same as LOCALDIR, over SFTP, copying
+    only the files that are missing or differ. Files are compared by size
+    and modification time, or with -c, by SHA-256 checksum, which runs
+    sha256sum on the hosts. Modes and modification times are kept. With
+    -delete, remote files and directories that aren't in LOCALDIR are
+    deleted. With -n, what would be copied and deleted is listed, but
+    nothing is changed. For example:
+
+    moltar prod/web sync -delete config :/etc/app/conf.d
+
+    Each file copied or deleted is reported, followed by a count for each
+    host, and the result on each host as for scp.
+
+  fetch [-r] [-z] REMOTE [REMOTE...] LOCALDIR
+
+    Copies REMOTE files from each host over SFTP into LOCALDIR/NAME, where
+    NAME is the host's name, followed by its ID if the name isn't unique.
+    Each file keeps its remote path under that directory, so files from
+    different hosts never overwrite each other. REMOTE may be a glob pattern,
+    quoted so that the local shell doesn't expand it, and relative paths are
+    from the user's home directory. With -r, directories are copied
+    recursively, following a symlink to one, and a directory with no files
+    fails the host. With -z, files are gzipped as they're written, with .gz
+    added to their names. For example:
+
+    moltar prod/web fetch '/var/log/app/*.log' logs
+    # Copies the app's logs from each host to logs/NAME/var/log/app/.
+
+    A host fails if any REMOTE doesn't match a file on it. Files copied and
+    the result on each host are reported as for scp.
+
   ls
 
-    Lists all hosts in the given environment, by Name tag and hostname.
+    Lists all hosts in the given environment, by instance ID, name, project,
+    environment, cluster and hostname.
 
   hostname NAME
 
@@ -110,6 +370,113 @@ Where CMD is one of:
   	the ls/exec commands, without looking at the current directory's package
   	list by default.
 
+  retry
+
+    Runs the last exec, run, deploy, install, scp, sync or fetch again, on
+    just the instances that didn't succeed. It's given the same arguments,
+    project, packages and package version, and the same -parallel, -batch,
+    -batch-pause, -command-timeout, -timeout, -no-tty and -template options,
+    unless they're given again. The environment and cluster must be the same
+    as last time. For example:
+
+      moltar production exec 'sudo systemctl restart app'
+      moltar production retry
+
+After exec, run, deploy, install, scp, sync and fetch, a table summarising
+the result on each instance is printed, and moltar exits with status 0 if they
+all succeeded, 3 if the command failed or couldn't connect on every one of
+them, or 2 otherwise. Status 1 means moltar itself hit an error. A deploy
+whose commands succeeded on an instance, but stopped short as one failed on
+others, shows it as incomplete, and the .moltar-failed-deploy hook's
+FAILED_HOSTS only lists instances where a command failed.
+
+The command, its arguments and the result on each instance are saved to a
+.moltar-state file, next to the .moltar-config file, or if there isn't one,
+the .project-name file (or .moltar-project or .mxm-project), for the retry
+command and -only-failed to use. Without either, it's in the current
+directory. Each run replaces the last, so after a retry it only covers the
+instances retried.
+
+Pressing Ctrl-C (or sending SIGTERM) during any of those commands sends
+SIGTERM to the commands running on instances, or stops copying files, and
+closes their sessions if they haven't stopped a few seconds later. Instances
+not yet started and any deploy hooks are skipped. The summary shows which
+instances were interrupted part way through. Pressing Ctrl-C again quits at
+once, with status 130.
+
+Configuration:
+
+  Moltar looks for a .moltar-config file in the current directory and its
+  parents. It's an ini file, which may contain the following sections.
+
+  [tags]
+
+    Maps moltar's concepts to the tags on your instances. The defaults are:
+
+    project = Project
+    environment = Environment
+    cluster = Cluster
+    packages = Packages
+    name = Name
+    ssh_user = SshUser
+    packages_format = pipe
+
+    packages_format is 'pipe' for tags like '|app|worker|', or 'comma' for
+    tags like 'app,worker'.
+
+  [ssh]
+
+    address = private-ip
+    bastion = cluster=bastion
+    host_keys = console
+    known_hosts = ~/.moltar/known_hosts
+    identity_file = ~/.ssh/deploy.pem
+    user = ubuntu
+    connect_timeout = 30s
+    connect_retries = 2
+
+    Defaults for the -address, -bastion, -host-keys, -i, -connect-timeout and
+    -connect-retries options.
+    known_hosts is the file moltar adds verified host keys to. user is the
+    SSH user for instances that aren't given one any other way.
+
+  [users]
+
+    ami-0abc1234 = admin
+    amzn2-ami-* = ec2-user
+    debian-* = admin
+
+    SSH users for instances launched from an AMI, by its ID or a pattern
+    matching its name. The first that matches is used. An instance's SshUser
+    tag takes precedence over these, and the User in ~/.ssh/config and then
+    the [ssh] user come after them.
+
+  [keys]
+
+    my-keypair = ~/.ssh/my-keypair.pem
+
+    Maps the names of EC2 key pairs to private key files, so each instance is
+    connected to with the key it was launched with.
+
+  [target NAME]
+
+    Look for instances in another region or account. Give as many targets as
+    you like; they're all queried at once and their instances merged. For
+    example:
+
+    [target eu]
+    region = eu-west-1
+
+    [target us]
+    region = us-east-1
+    profile = myproject-us
+
+    profile is the AWS credentials profile to use, and defaults to the project
+    name. region defaults to the profile's region. With more than one target,
+    ls and exec output show each instance's region and account. Targets with
+    different profiles can't be used while AWS_ACCESS_KEY_ID and
+    AWS_SECRET_ACCESS_KEY are set, as those would be used for all of them.
+
 `
 
 func usage() {